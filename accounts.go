@@ -0,0 +1,144 @@
+/*
+This file holds the accounts - the cash wallet, the checking account, the credit
+card - with their balances, and the transfers of money between them
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountKinds are the kinds of accounts, in the order they are offered
+var accountKinds = []string{"cash", "checking", "credit card", "savings"}
+
+// Account is a place the money is kept in. The balance is the opening balance
+// with all transactions and transfers of the account.
+type Account struct {
+	ID      int
+	Name    string
+	Kind    string
+	Opening float64
+	Balance float64
+}
+
+// Transfer moves money from one account to another. It is neither income nor
+// expense, so it doesn't touch the magic number or any sum of expenses.
+type Transfer struct {
+	ID          int
+	From        int
+	To          int
+	Amount      float64
+	Description string
+	Timestamp   time.Time
+}
+
+// RegisterLine is a transaction or transfer of an account with the balance after it.
+// Cleared lines showed up on a bank statement, reconciled ones are locked.
+type RegisterLine struct {
+	TransactionID  int
+	TransferID     int
+	Date           string
+	Description    string
+	Amount         float64
+	Balance        float64
+	Cleared        bool
+	Reconciliation int
+}
+
+// parseAccount reads and checks the name, kind and opening balance of an account
+func parseAccount(name, kind, opening string) (Account, error) {
+	item := Account{Name: strings.TrimSpace(name), Kind: kind}
+	if item.Name == "" {
+		return item, errors.New("the account needs a name")
+	}
+	valid := false
+	for _, k := range accountKinds {
+		valid = valid || k == kind
+	}
+	if !valid {
+		return item, fmt.Errorf("unknown kind of account %q", kind)
+	}
+	if opening != "" {
+		var err error
+		if item.Opening, err = strconv.ParseFloat(opening, 64); err != nil {
+			return item, fmt.Errorf("invalid opening balance %q", opening)
+		}
+	}
+	return item, nil
+}
+
+// saveAccount stores a new account (ID 0) of a budget or changes an existing one.
+// Names have to be unique within the budget, regardless of case.
+func saveAccount(ctx context.Context, db *sql.DB, budget int, item Account) (int, error) {
+	if other := findAccount(ctx, db, budget, item.Name); other != 0 && other != item.ID {
+		return 0, fmt.Errorf("there already is an account %q", item.Name)
+	}
+	if item.ID == 0 {
+		return StoreAccount(ctx, db, budget, item)
+	}
+	if ReadAccount(ctx, db, budget, item.ID).ID == 0 {
+		return 0, errors.New("unknown account")
+	}
+	return item.ID, ChangeAccount(ctx, db, budget, item)
+}
+
+// removeAccount deletes an account without any transactions or transfers.
+// The last account of a budget stays - new transactions need one.
+func removeAccount(ctx context.Context, db *sql.DB, budget, id int) error {
+	if ReadAccount(ctx, db, budget, id).ID == 0 {
+		return errors.New("unknown account")
+	}
+	if count := countAccountUse(ctx, db, id); count > 0 {
+		return fmt.Errorf("the account still has %d transactions and transfers", count)
+	}
+	accounts, err := ReadAccounts(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 1 {
+		return errors.New("the last account can't be deleted")
+	}
+	return DeleteAccount(ctx, db, budget, id)
+}
+
+// transferMoney stores a transfer between two different accounts of a budget
+func transferMoney(ctx context.Context, db *sql.DB, budget int, user User, item Transfer) error {
+	if item.Amount <= 0 {
+		return errors.New("the amount of a transfer has to be positive")
+	}
+	if item.From == item.To {
+		return errors.New("a transfer needs two different accounts")
+	}
+	if ReadAccount(ctx, db, budget, item.From).ID == 0 || ReadAccount(ctx, db, budget, item.To).ID == 0 {
+		return errors.New("unknown account")
+	}
+	item.Description = strings.TrimSpace(item.Description)
+	_, err := StoreTransfer(ctx, db, budget, user, item)
+	return err
+}
+
+// removeTransfer deletes a transfer of a budget, unless it is reconciled on one of its accounts
+func removeTransfer(ctx context.Context, db *sql.DB, budget int, user User, id int) error {
+	if readTransferLock(ctx, db, budget, id) {
+		return errLocked
+	}
+	return DeleteTransfer(ctx, db, budget, user, id)
+}
+
+// accountRegister returns the transactions and transfers of an account of a budget, oldest first,
+// each with the balance right after it
+func accountRegister(ctx context.Context, db *sql.DB, budget int, account Account) ([]RegisterLine, error) {
+	lines, err := ReadRegister(ctx, db, budget, account.ID)
+	balance := account.Opening
+	for i := range lines {
+		balance += lines[i].Amount
+		lines[i].Balance = balance
+	}
+	return lines, err
+}
@@ -0,0 +1,227 @@
+/*
+This file holds the JSON API - the same data as the web pages,
+for scripts and other tools
+*/
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiTransaction is a single transaction as seen by the API
+type apiTransaction struct {
+	ID          int        `json:"id,omitempty"`
+	Date        string     `json:"date"`
+	Description string     `json:"description"`
+	Amount      float64    `json:"amount"`
+	Income      bool       `json:"income"`
+	Category    string     `json:"category,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Splits      []apiSplit `json:"splits,omitempty"`
+}
+
+// apiSplit is a part of a split transaction as seen by the API
+type apiSplit struct {
+	Amount   float64 `json:"amount"`
+	Category string  `json:"category,omitempty"`
+}
+
+// writeJSON writes v as JSON with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error message as {"error": "..."}
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeServerError answers an API request whose work failed, like serverError but as JSON
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	writeJSONError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// apiQuickAdd parses a quick-add line (form value q) and returns its interpretation.
+// Only with save=true the transaction is stored as well.
+func apiQuickAdd(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	quick, err := parseQuickAdd(r.FormValue("q"), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result := apiTransaction{Date: quick.Date(), Description: quick.Description,
+		Amount: quick.Amount, Income: quick.Income, Category: quick.Category, Tags: quick.Tags}
+	if r.FormValue("save") != "true" {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	if err := storeQuickAdd(ctx, currentBudget(r).ID, currentUser(r), quick); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// apiCategory is a category with its usage as seen by the API
+type apiCategory struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Parent string `json:"parent,omitempty"`
+	CategoryUsage
+}
+
+// apiCategories lists all categories with their path and usage
+func apiCategories(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	nodes = sortTree(nodes)
+	paths := categoryPaths(nodes)
+	names := make(map[int64]string)
+	for _, node := range nodes {
+		names[int64(node.ID)] = node.Name
+	}
+	result := []apiCategory{}
+	for _, node := range nodes {
+		result = append(result, apiCategory{Name: node.Name, Path: paths[node.Name], Parent: names[node.Parent.Int64],
+			CategoryUsage: ReadCategoryUsage(ctx, db, budget, node.Name)})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiChangeCategory renames, merges or deletes a category (form values name and target).
+// With dry_run=true only the affected counts are returned.
+func apiChangeCategory(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	action, name, target := pr.ByName("action"), r.FormValue("name"), r.FormValue("target")
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if err := checkCategoryChange(nodes, action, name, target); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	usage := ReadCategoryUsage(ctx, db, budget, name)
+	if r.FormValue("dry_run") == "true" {
+		writeJSON(w, http.StatusOK, usage)
+		return
+	}
+	if err := changeCategory(ctx, db, budget, currentUser(r), action, name, target); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// apiTags returns the totals per tag between the dates from and to (optional, 2006-01-02)
+func apiTags(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	from, to := r.FormValue("from"), r.FormValue("to")
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid date "+date)
+			return
+		}
+	}
+	result, err := SumTags(ctx, db, currentBudget(r).ID, from, to)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if result == nil {
+		result = []TagTotal{}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiReports returns the comparison report, with the same parameters as the reports page
+func apiReports(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	month, err := parseReportMonth(r.FormValue("month"), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	months, err := parseReportMonths(r.FormValue("months"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := buildReport(ctx, db, currentBudget(r).ID, month, months)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// apiAccount is an account as returned by the API
+type apiAccount struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Kind    string  `json:"kind"`
+	Opening float64 `json:"opening"`
+	Balance float64 `json:"balance"`
+}
+
+// apiAccounts returns all accounts with their current balance
+func apiAccounts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	accounts, err := ReadAccounts(ctx, db, currentBudget(r).ID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	result := []apiAccount{}
+	for _, item := range accounts {
+		result = append(result, apiAccount{ID: item.ID, Name: item.Name, Kind: item.Kind, Opening: item.Opening, Balance: item.Balance})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiTransactions returns a page of the transactions, filtered like the transactions browser
+func apiTransactions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	filter, err := parseTransactionFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	count, sum := CountTransactions(ctx, db, budget, filter)
+	transactions, err := SearchTransactions(ctx, db, budget, filter)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	result := []apiTransaction{}
+	for _, item := range transactions {
+		trans := apiTransaction{ID: item.ID, Date: item.Date, Description: item.Description, Amount: item.Amount,
+			Income: item.Amount > 0, Category: item.Mapping, Tags: item.Tags}
+		for _, split := range item.Splits {
+			trans.Splits = append(trans.Splits, apiSplit{Amount: split.Amount, Category: split.Mapping})
+		}
+		result = append(result, trans)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"transactions": result, "count": count, "sum": sum,
+		"page": filter.Page, "per_page": filter.PerPage, "pages": filter.Pages(count)})
+}
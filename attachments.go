@@ -0,0 +1,134 @@
+/*
+This file holds the attachments - receipts, invoices and warranty papers
+kept next to their transaction, either as files in the attachment directory
+or inside the database
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// attachmentTypes are the accepted kinds of files. The type is detected
+// from the content - the name of the file and the browser's word don't count.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// Attachment is a file attached to a transaction. Path is the name of the file
+// in the attachment directory - invalid if the content is stored in the database.
+type Attachment struct {
+	ID            int
+	TransactionID int
+	Filename      string
+	ContentType   string
+	Size          int64
+	Path          sql.NullString
+	Created       time.Time
+}
+
+// SizeText returns the size for display, like "1.2 MB"
+func (a Attachment) SizeText() string {
+	switch {
+	case a.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1<<20))
+	case a.Size >= 1<<10:
+		return fmt.Sprintf("%.0f kB", float64(a.Size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", a.Size)
+}
+
+// readUpload reads an uploaded file of at most max bytes and detects its content type
+func readUpload(file io.Reader, max int64) ([]byte, string, error) {
+	data, err := io.ReadAll(io.LimitReader(file, max+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > max {
+		return nil, "", fmt.Errorf("the file is larger than %s", Attachment{Size: max}.SizeText())
+	}
+	if len(data) == 0 {
+		return nil, "", errors.New("the file is empty")
+	}
+	contentType := http.DetectContentType(data)
+	if !attachmentTypes[contentType] {
+		return nil, "", fmt.Errorf("files of type %s can't be attached - only images and PDFs", contentType)
+	}
+	return data, contentType, nil
+}
+
+// attachFile stores the content of a file as attachment of a transaction. With a directory
+// given, the content goes into a file named after its checksum, so the same receipt is only
+// stored once. Otherwise the content is stored in the database.
+func attachFile(ctx context.Context, db *sql.DB, budget int, user User, dir string, transaction int, filename string, data []byte, contentType string) error {
+	_, err := getSingle(ctx, db, budget, transaction, "transactions")
+	if err != nil {
+		return err
+	}
+	item := Attachment{TransactionID: transaction, Filename: filepath.Base(filename), ContentType: contentType, Size: int64(len(data))}
+	if dir == "" {
+		return StoreAttachment(ctx, db, budget, user, item, data)
+	}
+	sum := sha256.Sum256(data)
+	item.Path = ToNullString(hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, item.Path.String)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return StoreAttachment(ctx, db, budget, user, item, nil)
+}
+
+// attachmentContent returns the content of an attachment, from the database or its file
+func attachmentContent(ctx context.Context, db *sql.DB, budget int, dir string, id int) (Attachment, []byte, error) {
+	item, data := ReadAttachment(ctx, db, budget, id)
+	if item.ID == 0 {
+		return item, nil, os.ErrNotExist
+	}
+	if !item.Path.Valid {
+		return item, data, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, item.Path.String))
+	return item, data, err
+}
+
+// removeAttachment deletes an attachment - and its file, once nothing refers to it anymore
+func removeAttachment(ctx context.Context, db *sql.DB, budget int, user User, dir string, id int) error {
+	item, _ := ReadAttachment(ctx, db, budget, id)
+	if item.ID == 0 {
+		return os.ErrNotExist
+	}
+	count, err := DeleteAttachment(ctx, db, budget, user, id)
+	if err != nil {
+		return err
+	}
+	if count == 0 && item.Path.Valid && dir != "" {
+		if err := os.Remove(filepath.Join(dir, item.Path.String)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
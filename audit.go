@@ -0,0 +1,464 @@
+/*
+This file holds the audit log - who added or changed which transaction, fixed item,
+categorization, split, share, attachment, transfer or category when, with the values
+before and after
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The number of changes shown per page of the activity feed
+const activityPerPage = 100
+
+// auditFields are the logged values, in the order they are shown
+var auditFields = []string{"description", "pattern", "category", "amount", "income", "recurrence", "account", "from", "to",
+	"tags", "note", "splits", "paid by", "shares", "attachment"}
+
+// auditParts are the kinds logged for the parts of a transaction, shown in its history as well
+var auditParts = []string{"split", "shares", "attachment"}
+
+// execer is a database or a database transaction, for functions used inside transactions as well
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is a database or a database transaction, for reads that have to see the
+// changes of the transaction they run in
+type querier interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// AuditEntry is a change in the audit log. Old and New hold the values as JSON,
+// empty for inserts (Old) and deletes (New).
+type AuditEntry struct {
+	ID     int
+	Time   string
+	User   string
+	Action string
+	Kind   string
+	ItemID int
+	Old    string
+	New    string
+}
+
+// AuditChange is a single value before and after a change
+type AuditChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// auditItem holds the logged values of a transaction or fixed item
+type auditItem struct {
+	Description string   `json:"description"`
+	Amount      float64  `json:"amount"`
+	Income      bool     `json:"income"`
+	Recurrence  string   `json:"recurrence,omitempty"`
+	Account     string   `json:"account,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Note        string   `json:"note,omitempty"`
+}
+
+// auditMapping holds the logged values of a categorization
+type auditMapping struct {
+	Description string `json:"description"`
+	Category    string `json:"category"`
+}
+
+// auditSplits holds the logged parts of a split transaction
+type auditSplits struct {
+	Description string   `json:"description"`
+	Splits      []string `json:"splits,omitempty"`
+}
+
+// auditShares holds who paid a transaction and its logged shares
+type auditShares struct {
+	Description string   `json:"description"`
+	PaidBy      string   `json:"paid by,omitempty"`
+	Shares      []string `json:"shares,omitempty"`
+}
+
+// auditAttachment holds the logged file of an attachment
+type auditAttachment struct {
+	Description string `json:"description"`
+	Attachment  string `json:"attachment"`
+}
+
+// auditTransfer holds the logged values of a transfer
+type auditTransfer struct {
+	Description string  `json:"description,omitempty"`
+	Amount      float64 `json:"amount"`
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+}
+
+// auditRule holds the logged values of a rule
+type auditRule struct {
+	Pattern  string `json:"pattern"`
+	Category string `json:"category"`
+}
+
+// auditNode holds the logged name of a category in the tree
+type auditNode struct {
+	Category string `json:"category"`
+}
+
+// itemValues returns the values of a transaction or fixed item to log - the amount
+// without sign, like on the forms
+func itemValues(ctx context.Context, db querier, budget int, item Transaction) auditItem {
+	values := auditItem{Description: item.Description, Amount: math.Abs(item.Amount), Income: item.Income,
+		Recurrence: item.Recurrence, Tags: item.Tags, Note: item.Note}
+	if item.Account != 0 {
+		values.Account = ReadAccount(ctx, db, budget, item.Account).Name
+	}
+	return values
+}
+
+// storedValues returns the values of a transaction or fixed item to log, as stored by
+// the database transaction of the change
+func storedValues(ctx context.Context, tx querier, budget, id int, transtype string) (auditItem, error) {
+	item, err := getSingle(ctx, tx, budget, id, transtype)
+	if err != nil {
+		return auditItem{}, err
+	}
+	return itemValues(ctx, tx, budget, item), nil
+}
+
+// mappingValues returns the values of a categorization to log
+func mappingValues(cat Category) auditMapping {
+	return auditMapping{Description: cat.Description, Category: cat.Mapping.String}
+}
+
+// transactionDescription returns the description of a transaction, to tell the logged parts apart
+func transactionDescription(ctx context.Context, db querier, id int) string {
+	var description string
+	row := db.QueryRowContext(ctx, "SELECT description FROM transactions WHERE id = ?", id)
+	_ = row.Scan(&description)
+	return description
+}
+
+// splitValues returns the parts of a transaction to log
+func splitValues(ctx context.Context, db querier, budget, id int) (auditSplits, error) {
+	values := auditSplits{Description: transactionDescription(ctx, db, id)}
+	splits, err := ReadSplits(ctx, db, budget, id)
+	if err != nil {
+		return values, err
+	}
+	for _, split := range splits {
+		mapping := split.Mapping
+		if mapping == "" {
+			mapping = uncategorised
+		}
+		values.Splits = append(values.Splits, fmt.Sprintf("%s %.2f", mapping, split.Amount))
+	}
+	return values, nil
+}
+
+// shareValues returns who paid a transaction and its shares to log
+func shareValues(ctx context.Context, db querier, budget, id int) (auditShares, error) {
+	values := auditShares{Description: transactionDescription(ctx, db, id)}
+	paidBy, shares, err := ReadShares(ctx, db, budget, id)
+	if err != nil {
+		return values, err
+	}
+	row := db.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", paidBy)
+	_ = row.Scan(&values.PaidBy)
+	for _, share := range shares {
+		values.Shares = append(values.Shares, fmt.Sprintf("%s %.2f", share.Name, share.Amount))
+	}
+	return values, nil
+}
+
+// parts returns the payer and the shares together, to compare them
+func (values auditShares) parts() []string {
+	if values.PaidBy == "" {
+		return values.Shares
+	}
+	return append([]string{values.PaidBy}, values.Shares...)
+}
+
+// transferValues returns the values of a transfer to log
+func transferValues(ctx context.Context, db querier, id int) auditTransfer {
+	var values auditTransfer
+	row := db.QueryRowContext(ctx, `SELECT COALESCE(description, ''), amount, source.name, target.name FROM transfers
+		JOIN accounts AS source ON source.id = from_account JOIN accounts AS target ON target.id = to_account WHERE transfers.id = ?`, id)
+	_ = row.Scan(&values.Description, &values.Amount, &values.From, &values.To)
+	return values
+}
+
+// partsAction returns how the parts of a transaction change - empty if they stay the same
+func partsAction(old, new []string) string {
+	switch {
+	case strings.Join(old, "\n") == strings.Join(new, "\n"):
+		return ""
+	case len(old) == 0:
+		return "insert"
+	case len(new) == 0:
+		return "delete"
+	}
+	return "update"
+}
+
+// categoryUse holds what refers to a category of a budget, to log how a rename,
+// merge or delete of the category changes it
+type categoryUse struct {
+	name      string
+	node      int
+	mappings  []Category
+	splits    []int
+	oldSplits []auditSplits
+	rules     []Rule
+}
+
+// readCategoryUse returns what refers to a category of a budget
+func readCategoryUse(ctx context.Context, db querier, budget int, name string) (categoryUse, error) {
+	use := categoryUse{name: name}
+	row := db.QueryRowContext(ctx, "SELECT id FROM categories WHERE budget = ? AND name = ?", budget, name)
+	if err := row.Scan(&use.node); err != nil && err != sql.ErrNoRows {
+		return use, err
+	}
+	err := queryRows(ctx, db, func(rows *sql.Rows) error {
+		var cat Category
+		err := rows.Scan(&cat.ID, &cat.Mapping, &cat.Description)
+		use.mappings = append(use.mappings, cat)
+		return err
+	}, "SELECT id, mapping, description FROM mappings WHERE budget = ? AND mapping = ? ORDER BY id", budget, name)
+	if err != nil {
+		return use, err
+	}
+	err = queryRows(ctx, db, func(rows *sql.Rows) error {
+		var id int
+		err := rows.Scan(&id)
+		use.splits = append(use.splits, id)
+		return err
+	}, `SELECT DISTINCT transaction_id FROM splits JOIN transactions ON transactions.id = splits.transaction_id
+		WHERE budget = ? AND mapping = ? ORDER BY transaction_id`, budget, name)
+	if err != nil {
+		return use, err
+	}
+	for _, id := range use.splits {
+		values, err := splitValues(ctx, db, budget, id)
+		if err != nil {
+			return use, err
+		}
+		use.oldSplits = append(use.oldSplits, values)
+	}
+	err = queryRows(ctx, db, func(rows *sql.Rows) error {
+		var rule Rule
+		err := rows.Scan(&rule.ID, &rule.Pattern, &rule.Mapping)
+		use.rules = append(use.rules, rule)
+		return err
+	}, "SELECT id, pattern, mapping FROM rules WHERE budget = ? AND mapping = ? ORDER BY id", budget, name)
+	return use, err
+}
+
+// queryRows runs a query and calls scan for every row of the result
+func queryRows(ctx context.Context, db querier, scan func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// audit logs the changes of a rename or merge into target, or a delete, of a category,
+// once they are made. Deleted rules and descriptions have no new values.
+func (use categoryUse) audit(ctx context.Context, db querier, budget int, user User, action, target string) error {
+	change := "update"
+	if action == "delete" {
+		change = "delete"
+	}
+	for _, cat := range use.mappings {
+		var newValues interface{}
+		if action != "delete" {
+			newValues = auditMapping{Description: cat.Description, Category: target}
+		}
+		if err := StoreAudit(ctx, db, budget, user, change, "category", int(FromNullInt64(cat.ID)), mappingValues(cat), newValues); err != nil {
+			return err
+		}
+	}
+	for i, id := range use.splits {
+		values, err := splitValues(ctx, db, budget, id)
+		if err != nil {
+			return err
+		}
+		if err := StoreAudit(ctx, db, budget, user, "update", "split", id, use.oldSplits[i], values); err != nil {
+			return err
+		}
+	}
+	for _, rule := range use.rules {
+		var newValues interface{}
+		if action != "delete" {
+			newValues = auditRule{Pattern: rule.Pattern, Category: target}
+		}
+		if err := StoreAudit(ctx, db, budget, user, change, "rule", rule.ID, auditRule{Pattern: rule.Pattern, Category: rule.Mapping}, newValues); err != nil {
+			return err
+		}
+	}
+	if action == "rename" {
+		return StoreAudit(ctx, db, budget, user, "update", "category tree", use.node, auditNode{Category: use.name}, auditNode{Category: target})
+	}
+	return StoreAudit(ctx, db, budget, user, "delete", "category tree", use.node, auditNode{Category: use.name}, nil)
+}
+
+// mappingAction returns how a categorization changes - empty if it stays the same
+func mappingAction(old, cat Category) string {
+	switch {
+	case old.Description == cat.Description && old.Mapping.String == cat.Mapping.String:
+		return ""
+	case cat.Mapping.String == "":
+		return "delete"
+	}
+	return "update"
+}
+
+// auditValues reads logged values - nil for none
+func auditValues(data string) map[string]interface{} {
+	if data == "" {
+		return nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return nil
+	}
+	return values
+}
+
+// auditText shows a logged value
+func auditText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return fmt.Sprintf("%.2f", v)
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			list = append(list, auditText(item))
+		}
+		return strings.Join(list, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// Changes returns the values of an entry that changed - all values of inserts
+func (e AuditEntry) Changes() []AuditChange {
+	old, new := auditValues(e.Old), auditValues(e.New)
+	var changes []AuditChange
+	for _, field := range auditFields {
+		change := AuditChange{Field: field, Old: auditText(old[field]), New: auditText(new[field])}
+		if change.Old == change.New {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Description returns the description of the changed item, to tell the entries apart -
+// the pattern of rules and the name of categories in the tree
+func (e AuditEntry) Description() string {
+	values := auditValues(e.New)
+	if values == nil {
+		values = auditValues(e.Old)
+	}
+	for _, field := range []string{"description", "pattern", "category"} {
+		if text := auditText(values[field]); text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// Link returns the page of the changed item - for parts the page of their transaction,
+// empty for categorizations, rules, transfers and the category tree
+func (e AuditEntry) Link() string {
+	switch e.Kind {
+	case "transaction", "split", "shares", "attachment":
+		return fmt.Sprintf("/edit/transactions/%d", e.ItemID)
+	case "fixed":
+		return fmt.Sprintf("/edit/fixed/%d", e.ItemID)
+	}
+	return ""
+}
+
+// handleHistory shows the changes of a transaction or fixed item, newest first
+func handleHistory(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	kinds := map[string]string{"transactions": "transaction", "fixed": "fixed"}
+	kind, ok := kinds[pr.ByName("type")]
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := parsePage(r, "templates/audit.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	budget := currentBudget(r).ID
+	entries, err := ReadAudit(ctx, db, budget, kind, id, 0, -1)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	item, err := getSingle(ctx, db, budget, id, pr.ByName("type"))
+	if err != nil && !errors.Is(err, errNotFound) {
+		serverError(w, r, err)
+		return
+	}
+	title := "History"
+	if item.ID != 0 {
+		title = "History of " + item.Description
+	} else if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	t.ExecuteTemplate(w, "audit", map[string]interface{}{"title": title, "entries": entries,
+		"back": fmt.Sprintf("/edit/%s/%d", pr.ByName("type"), id)})
+}
+
+// handleActivity shows the latest changes of the budget - older ones with ?before=<id>
+func handleActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	t, err := parsePage(r, "templates/audit.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	entries, err := ReadAudit(ctx, db, currentBudget(r).ID, "", 0, before, activityPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var older int
+	if len(entries) == activityPerPage {
+		older = entries[len(entries)-1].ID
+	}
+	t.ExecuteTemplate(w, "audit", map[string]interface{}{"title": "Activity", "entries": entries, "feed": true, "older": older})
+}
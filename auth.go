@@ -0,0 +1,333 @@
+/*
+This file holds the users and how they sign in - with the login page and a
+session cookie, with HTTP basic auth, or through a reverse proxy that puts the
+name of the signed in user into a header
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The name of the session cookie and the shortest password accepted
+const (
+	sessionCookie     = "gofinance_session"
+	minPasswordLength = 8
+)
+
+// authModes are the ways to sign in, see the -auth flag
+var authModes = map[string]bool{"session": true, "basic": true, "proxy": true}
+
+// dummyHash is compared against for unknown users, so they take as long as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gofinance"), bcrypt.DefaultCost)
+
+// User is someone who can sign in
+type User struct {
+	ID   int
+	Name string
+}
+
+// contextKey is the type of the keys of the values GoFinance puts into a request's context
+type contextKey string
+
+// userKey holds the signed in user in the request's context
+const userKey contextKey = "user"
+
+// currentUser returns the signed in user of a request
+func currentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey).(User)
+	return user
+}
+
+// hashPassword checks a new password and returns its bcrypt hash
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("the password needs at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// addUser stores a new user with a password
+func addUser(ctx context.Context, db *sql.DB, name, password string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("the user needs a name")
+	}
+	user, _, err := ReadUser(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if user.ID != 0 {
+		return fmt.Errorf("there already is a user %q", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := StoreUser(ctx, db, name, hash); err != nil {
+		return err
+	}
+	// The first user owns the budgets that are there already
+	users, err := ReadUsers(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(users) == 1 {
+		return claimBudgets(ctx, db, users[0].ID)
+	}
+	return nil
+}
+
+// setPassword changes the password of a user - which signs the user out everywhere
+func setPassword(ctx context.Context, db *sql.DB, name, password string) error {
+	user, _, err := ReadUser(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		return fmt.Errorf("unknown user %q", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return ChangePassword(ctx, db, user.ID, hash)
+}
+
+// removeUser deletes a user
+func removeUser(ctx context.Context, db *sql.DB, name string) error {
+	user, _, err := ReadUser(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		return fmt.Errorf("unknown user %q", name)
+	}
+	return DeleteUser(ctx, db, user.ID)
+}
+
+// authenticate checks the name and password of a user
+func authenticate(ctx context.Context, db *sql.DB, name, password string) (User, bool, error) {
+	user, hash, err := ReadUser(ctx, db, name)
+	if err != nil {
+		return User{}, false, err
+	}
+	if user.ID == 0 || hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, false, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, false, nil
+	}
+	return user, true, nil
+}
+
+// hashToken returns the hash a session token is stored by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession starts a session for a user and sets its cookie
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	ctx := r.Context()
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	expires := time.Now().Add(*sessionMaxAge)
+	if err := StoreSession(ctx, db, hashToken(token), user.ID, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, Secure: secureCookie(r), SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// sessionUser returns the user of the session cookie of a request - an ID of 0 without one
+func sessionUser(r *http.Request) User {
+	ctx := r.Context()
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return User{}
+	}
+	return ReadSession(ctx, db, hashToken(cookie.Value))
+}
+
+// parseProxies reads the comma separated addresses or CIDR ranges of the trusted reverse proxies
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		cidr := item
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q", item)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// fromProxy checks that a request comes from one of the trusted reverse proxies
+func fromProxy(r *http.Request, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuth lets only signed in users through to the handler - everybody else gets to the
+// login page (or a 401 for the API). How users sign in depends on the -auth flag. The
+// session mode also accepts HTTP basic auth, for scripts using the API.
+func requireAuth(next http.Handler, mode string, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var user User
+		var err error
+		switch mode {
+		case "proxy":
+			if !fromProxy(r, proxies) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			user, _, err = ReadUser(ctx, db, r.Header.Get(*authHeader))
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if user.ID == 0 {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		case "basic":
+			name, password, _ := r.BasicAuth()
+			user, _, err = authenticate(ctx, db, name, password)
+		default:
+			if r.URL.Path == "/login" || strings.HasPrefix(r.URL.Path, "/static/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user = sessionUser(r)
+			if name, password, ok := r.BasicAuth(); user.ID == 0 && ok {
+				user, _, err = authenticate(ctx, db, name, password)
+			}
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if user.ID == 0 {
+			switch {
+			case mode == "basic":
+				w.Header().Set("WWW-Authenticate", `Basic realm="GoFinance", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			case strings.HasPrefix(r.URL.Path, "/api/"):
+				writeJSONError(w, http.StatusUnauthorized, "not signed in")
+			case r.Method == "GET":
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), 303)
+			default:
+				http.Redirect(w, r, "/login", 303)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	})
+}
+
+// localPath returns the path to go to after signing in - only paths on this server, "/" otherwise
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// handleLogin shows the login page
+func handleLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Signed in by basic auth or the proxy already
+	if *authMode != "session" {
+		http.Redirect(w, r, "/", 303)
+		return
+	}
+	renderLogin(w, r, r.URL.Query().Get("next"), "")
+}
+
+// renderLogin renders the login page with an optional error
+func renderLogin(w http.ResponseWriter, r *http.Request, next, loginError string) {
+	t, err := parsePage(r, "templates/login.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	t.ExecuteTemplate(w, "login", map[string]interface{}{"next": localPath(next), "error": loginError})
+}
+
+// login checks the name and password from the login page and starts a session
+func login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user, ok, err := authenticate(ctx, db, r.FormValue("name"), r.FormValue("password"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !ok {
+		log.Println("Failed login for ", r.FormValue("name"), " from ", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		renderLogin(w, r, r.FormValue("next"), "Wrong name or password")
+		return
+	}
+	if err := startSession(w, r, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, localPath(r.FormValue("next")), 303)
+}
+
+// logout ends the session
+func logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := DeleteSession(ctx, db, hashToken(cookie.Value)); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1,
+		HttpOnly: true, Secure: secureCookie(r), SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/login", 303)
+}
@@ -0,0 +1,318 @@
+/*
+This file holds the backup and restore logic - online snapshots of the
+running database, rotating scheduled backups and the restore command
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are named gofin-<timestamp>.db so they sort chronologically.
+// The attachment files of all backups share one directory next to them.
+const (
+	backupPrefix      = "gofin-"
+	backupSuffix      = ".db"
+	backupLayout      = "20060102-150405"
+	backupAttachments = "attachments"
+)
+
+// snapshot writes a consistent copy of the database to path.
+// VACUUM INTO runs inside a read transaction, so the server can keep on
+// running (and writing) while the snapshot is taken.
+func snapshot(ctx context.Context, db *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// backupNow takes a snapshot into dir, together with the attachment files stored in the
+// directory attachments, and removes everything but the newest keep backups.
+// Returns the path of the new backup.
+func backupNow(ctx context.Context, db *sql.DB, dir, attachments string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupPrefix+time.Now().Format(backupLayout)+backupSuffix)
+	if err := snapshot(ctx, db, path); err != nil {
+		return "", err
+	}
+	// The files never change (they are named after their checksum), so the
+	// ones already backed up don't need to be copied again
+	files, err := readBackupAttachments(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if len(files) > 0 && attachments == "" {
+		return "", fmt.Errorf("%d attachments are stored as files, but no attachment directory is set", len(files))
+	}
+	if err := copyMissing(files, attachments, filepath.Join(dir, backupAttachments)); err != nil {
+		return "", err
+	}
+	if err := rotateBackups(dir, keep); err != nil {
+		return "", err
+	}
+	return path, pruneAttachments(ctx, dir)
+}
+
+// copyMissing copies the files from the directory src to dst, unless they are there already
+func copyMissing(files []string, src, dst string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(dst, file)); err == nil {
+			continue
+		}
+		tmp := filepath.Join(dst, file+".tmp")
+		if err := copyFile(filepath.Join(src, file), tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dst, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneAttachments deletes the attachment files in the backup directory dir
+// no backup refers to anymore
+func pruneAttachments(ctx context.Context, dir string) error {
+	files, err := os.ReadDir(filepath.Join(dir, backupAttachments))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, path := range backups {
+		paths, err := readBackupAttachments(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, file := range paths {
+			used[file] = true
+		}
+	}
+	for _, file := range files {
+		if !used[file.Name()] {
+			if err := os.Remove(filepath.Join(dir, backupAttachments, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readBackupAttachments returns the attachment files a backup refers to.
+// Backups from before attachments existed have none.
+func readBackupAttachments(ctx context.Context, path string) ([]string, error) {
+	backup, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer backup.Close()
+	var name string
+	row := backup.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'attachments'")
+	if err := row.Scan(&name); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return readAttachmentPaths(ctx, backup)
+}
+
+// listBackups returns all backups in dir, oldest first
+func listBackups(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// rotateBackups deletes the oldest backups, so only keep of them are left.
+// A keep of 0 or less keeps everything.
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// scheduleBackups takes a backup every interval until the context is canceled - a
+// running backup still completes. Errors are only logged - a failed backup must not
+// take the server down.
+func scheduleBackups(ctx context.Context, db *sql.DB, dir, attachments string, every time.Duration, keep int) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		path, err := backupNow(context.WithoutCancel(ctx), db, dir, attachments, keep)
+		if err != nil {
+			log.Println("Backup failed: ", err)
+			continue
+		}
+		log.Println("Backup written to ", path)
+	}
+}
+
+// validateBackup checks that a file is an intact GoFinance database this build understands
+func validateBackup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	backup, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	var check string
+	if err := backup.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&check); err != nil {
+		return fmt.Errorf("%s is not a database: %v", path, err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("%s is damaged: %s", path, check)
+	}
+	version := readSchemaVersion(ctx, backup)
+	if version > schemaVersion {
+		return fmt.Errorf("%s has schema version %d, this version of GoFinance only knows up to %d", path, version, schemaVersion)
+	}
+	for _, table := range []string{"fixed", "transactions", "mappings"} {
+		var name string
+		row := backup.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+		if err := row.Scan(&name); err != nil {
+			return fmt.Errorf("%s is missing the table %s", path, table)
+		}
+	}
+	return nil
+}
+
+// sqliteSidecars are the files SQLite keeps next to a database while it is used. Left
+// next to a restored database, they would be applied to it as if they were its own.
+var sqliteSidecars = []string{"-wal", "-shm", "-journal"}
+
+// restoreBackup replaces the database at dbpath with the backup at path and puts the
+// backed up attachment files back into the directory attachments.
+// The server must not be running. The replaced database is kept as <dbpath>.before-restore,
+// together with its sidecar files.
+func restoreBackup(ctx context.Context, path, dbpath, attachments string) error {
+	if err := validateBackup(ctx, path); err != nil {
+		return err
+	}
+	files, err := readBackupAttachments(ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 && attachments == "" {
+		return fmt.Errorf("the backup has %d attachments stored as files, but no attachment directory is set", len(files))
+	}
+	if err := copyMissing(files, filepath.Join(filepath.Dir(path), backupAttachments), attachments); err != nil {
+		return err
+	}
+	// Copy next to the database first, so the swap itself is a simple rename
+	tmp := dbpath + ".restore"
+	if err := copyFile(path, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := keepReplaced(dbpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dbpath)
+}
+
+// keepReplaced moves the database at dbpath and its sidecars out of the way, to
+// <dbpath>.before-restore. The sidecars of an earlier restore are removed, so they aren't
+// taken for the ones of the replaced database, and sidecars without a database are stale.
+func keepReplaced(dbpath string) error {
+	kept := dbpath + ".before-restore"
+	_, err := os.Stat(dbpath)
+	replaced := err == nil
+	if replaced {
+		if err := os.Rename(dbpath, kept); err != nil {
+			return err
+		}
+	}
+	for _, sidecar := range sqliteSidecars {
+		if replaced {
+			if err := os.Remove(kept + sidecar); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			err = os.Rename(dbpath+sidecar, kept+sidecar)
+		} else {
+			err = os.Remove(dbpath + sidecar)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file src to dst and syncs it to the disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
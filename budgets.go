@@ -0,0 +1,342 @@
+/*
+This file holds the budgets - every household keeps its own transactions, fixed items,
+categories, rules, tags and accounts, shared by its members. Owners manage the members,
+editors change the budget and viewers only look at it.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// budgetRoles are the roles of the members, in the order they are offered
+var budgetRoles = []string{"owner", "editor", "viewer"}
+
+// budgetCookie keeps the budget a user works on
+const budgetCookie = "gofinance_budget"
+
+// budgetKey holds the selected budget in the request's context
+const budgetKey contextKey = "budget"
+
+// Budget is a household with its own finances. The role is the one of the signed in user.
+type Budget struct {
+	ID   int
+	Name string
+	Role string
+}
+
+// Member is a user with a role in a budget
+type Member struct {
+	User
+	Role string
+}
+
+// currentBudget returns the selected budget of a request
+func currentBudget(r *http.Request) Budget {
+	budget, _ := r.Context().Value(budgetKey).(Budget)
+	return budget
+}
+
+// selectBudget returns the budget a user works on: the one asked for with ?budget=
+// (for scripts), the one of the cookie or the first one. An ID of 0 if the user has none,
+// or isn't a member of the one asked for.
+func selectBudget(r *http.Request, user User) (Budget, error) {
+	ctx := r.Context()
+	if selected := r.URL.Query().Get("budget"); selected != "" {
+		id, _ := strconv.Atoi(selected)
+		return ReadBudget(ctx, db, user.ID, id), nil
+	}
+	if cookie, err := r.Cookie(budgetCookie); err == nil {
+		id, _ := strconv.Atoi(cookie.Value)
+		if budget := ReadBudget(ctx, db, user.ID, id); budget.ID != 0 {
+			return budget, nil
+		}
+	}
+	budgets, err := ReadBudgets(ctx, db, user.ID)
+	if err != nil || len(budgets) == 0 {
+		return Budget{}, err
+	}
+	return budgets[0], nil
+}
+
+// checkRole checks the role of a member
+func checkRole(role string) error {
+	for _, r := range budgetRoles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q, use owner, editor or viewer", role)
+}
+
+// findBudget returns the ID of a budget given by ID or name (in any case) - the first
+// budget if none is given
+func findBudget(ctx context.Context, db *sql.DB, name string) (int, error) {
+	budgets, err := readAllBudgets(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if name == "" && len(budgets) > 0 {
+		return budgets[0].ID, nil
+	}
+	var found []int
+	for _, budget := range budgets {
+		if strconv.Itoa(budget.ID) == name {
+			return budget.ID, nil
+		}
+		if strings.EqualFold(budget.Name, name) {
+			found = append(found, budget.ID)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("unknown budget %q", name)
+	case 1:
+		return found[0], nil
+	}
+	return 0, fmt.Errorf("there are %d budgets %q, use the ID", len(found), name)
+}
+
+// createBudget starts a new budget owned by a user
+func createBudget(ctx context.Context, db *sql.DB, owner int, name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, errors.New("the budget needs a name")
+	}
+	return StoreBudget(ctx, db, name, owner)
+}
+
+// renameBudget gives a budget a new name
+func renameBudget(ctx context.Context, db *sql.DB, id int, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("the budget needs a name")
+	}
+	return ChangeBudget(ctx, db, id, name)
+}
+
+// setMemberRole adds a user (by name) to a budget or changes the user's role.
+// Every budget keeps at least one owner.
+func setMemberRole(ctx context.Context, db *sql.DB, budget int, name, role string) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	user, _, err := ReadUser(ctx, db, strings.TrimSpace(name))
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		return fmt.Errorf("unknown user %q", name)
+	}
+	if role != "owner" {
+		last, err := isLastOwner(ctx, db, budget, user.ID)
+		if err != nil {
+			return err
+		}
+		if last {
+			return errors.New("the budget needs another owner first")
+		}
+	}
+	return SetMember(ctx, db, budget, user.ID, role)
+}
+
+// removeMember takes a user (by name) out of a budget - but never its last owner
+func removeMember(ctx context.Context, db *sql.DB, budget int, name string) error {
+	user, _, err := ReadUser(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		return fmt.Errorf("unknown user %q", name)
+	}
+	last, err := isLastOwner(ctx, db, budget, user.ID)
+	if err != nil {
+		return err
+	}
+	if last {
+		return errors.New("the budget needs another owner first")
+	}
+	return DeleteMember(ctx, db, budget, user.ID)
+}
+
+// isLastOwner checks whether a user is the only owner of a budget
+func isLastOwner(ctx context.Context, db *sql.DB, budget, user int) (bool, error) {
+	members, err := ReadMembers(ctx, db, budget)
+	owners := 0
+	last := false
+	for _, member := range members {
+		if member.Role == "owner" {
+			owners++
+			last = member.ID == user
+		}
+	}
+	return owners == 1 && last, err
+}
+
+// budgetFree are the pages that work without a budget - to sign out and to pick or start one -
+// and the static files
+func budgetFree(path string) bool {
+	return path == "/login" || path == "/logout" || path == "/budgets" || strings.HasPrefix(path, "/confirm/budgets") ||
+		strings.HasPrefix(path, "/static/")
+}
+
+// requireBudget puts the budget the signed in user works on into the request's context.
+// Users without a budget get to the budgets page to start one, and viewers can't change anything.
+func requireBudget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if budgetFree(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		budget, err := selectBudget(r, currentUser(r))
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		switch {
+		case err != nil && api:
+			writeServerError(w, r, err)
+			return
+		case err != nil:
+			serverError(w, r, err)
+			return
+		case budget.ID == 0 && api:
+			writeJSONError(w, http.StatusForbidden, "not a member of the budget")
+			return
+		case budget.ID == 0:
+			http.Redirect(w, r, "/budgets", 303)
+			return
+		case budget.Role == "viewer" && r.Method != "GET" && r.Method != "HEAD" && api:
+			writeJSONError(w, http.StatusForbidden, "viewers can't change the budget")
+			return
+		case budget.Role == "viewer" && r.Method != "GET" && r.Method != "HEAD":
+			http.Error(w, "Viewers can't change the budget", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), budgetKey, budget)))
+	})
+}
+
+// setBudgetCookie remembers the budget a user works on
+func setBudgetCookie(w http.ResponseWriter, r *http.Request, id int) {
+	http.SetCookie(w, &http.Cookie{Name: budgetCookie, Value: strconv.Itoa(id), Path: "/", Expires: time.Now().AddDate(1, 0, 0),
+		HttpOnly: true, Secure: secureCookie(r), SameSite: http.SameSiteLaxMode})
+}
+
+// ownedBudget returns the budget of the URL if the signed in user owns it - an ID of 0 otherwise
+func ownedBudget(r *http.Request, pr httprouter.Params) Budget {
+	ctx := r.Context()
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	budget := ReadBudget(ctx, db, currentUser(r).ID, id)
+	if budget.Role != "owner" {
+		return Budget{}
+	}
+	return budget
+}
+
+// handleBudgets lists the budgets of the signed in user, with the members of the owned ones
+func handleBudgets(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	t, err := parsePage(r, "templates/budgets.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	user := currentUser(r)
+	members := make(map[int][]Member)
+	budgets, err := ReadBudgets(ctx, db, user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, budget := range budgets {
+		if budget.Role == "owner" {
+			if members[budget.ID], err = ReadMembers(ctx, db, budget.ID); err != nil {
+				serverError(w, r, err)
+				return
+			}
+		}
+	}
+	current, err := selectBudget(r, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "budgets", map[string]interface{}{"budgets": budgets, "members": members, "roles": budgetRoles,
+		"current": current.ID, "error": r.URL.Query().Get("error")})
+}
+
+// newBudget starts a budget owned by the signed in user and switches to it
+func newBudget(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	id, err := createBudget(ctx, db, currentUser(r).ID, r.FormValue("name"))
+	if err != nil {
+		http.Redirect(w, r, "/budgets?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	setBudgetCookie(w, r, id)
+	http.Redirect(w, r, "/", 303)
+}
+
+// switchBudget makes another budget of the signed in user the one to work on
+func switchBudget(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if ReadBudget(ctx, db, currentUser(r).ID, id).ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	setBudgetCookie(w, r, id)
+	http.Redirect(w, r, "/", 303)
+}
+
+// editBudget renames a budget - only for its owners
+func editBudget(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := ownedBudget(r, pr)
+	if budget.ID == 0 {
+		http.Error(w, "Only owners can change the budget", http.StatusForbidden)
+		return
+	}
+	if err := renameBudget(ctx, db, budget.ID, r.FormValue("name")); err != nil {
+		http.Redirect(w, r, "/budgets?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/budgets", 303)
+}
+
+// editMember adds a user (form values name and role) to a budget or changes the role - only for its owners
+func editMember(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := ownedBudget(r, pr)
+	if budget.ID == 0 {
+		http.Error(w, "Only owners can change the members", http.StatusForbidden)
+		return
+	}
+	if err := setMemberRole(ctx, db, budget.ID, r.FormValue("name"), r.FormValue("role")); err != nil {
+		http.Redirect(w, r, "/budgets?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/budgets", 303)
+}
+
+// deleteMember takes a user (form value name) out of a budget - only for its owners
+func deleteMember(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := ownedBudget(r, pr)
+	if budget.ID == 0 {
+		http.Error(w, "Only owners can change the members", http.StatusForbidden)
+		return
+	}
+	if err := removeMember(ctx, db, budget.ID, r.FormValue("name")); err != nil {
+		http.Redirect(w, r, "/budgets?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/budgets", 303)
+}
@@ -3,7 +3,12 @@ This file holds all calculation like sums, calculation of "magic number"
 */
 package main
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
 
 // calcRate Calculates the so-called "Magic Number"
 // The daily amount of money you can spend for a signle fixed expense/income
@@ -42,10 +47,16 @@ func daysInYear(year int) float64 {
 	return numdays
 }
 
-// Calculates the total expenses per period
-func expensesPerPeriod(period string, channel chan float64) {
-	expenses := totalExpenses(db, period)
-	magicNumber := baseMagic(db)
+// Calculates the total expenses of a budget per period
+func expensesPerPeriod(ctx context.Context, budget int, period string) (float64, error) {
+	expenses, err := totalExpenses(ctx, db, budget, period)
+	if err != nil {
+		return 0, err
+	}
+	magicNumber, err := baseMagic(ctx, db, budget)
+	if err != nil {
+		return 0, err
+	}
 	var total float64
 	switch period {
 	case "week":
@@ -55,7 +66,7 @@ func expensesPerPeriod(period string, channel chan float64) {
 	case "year":
 		total = (magicNumber * daysInYear(time.Now().Year())) + expenses
 	}
-	channel <- total
+	return total, nil
 }
 
 func percentages(total, transam float64) float64 {
@@ -64,3 +75,37 @@ func percentages(total, transam float64) float64 {
 	}
 	return (transam * 100) / total
 }
+
+// statsRange returns the first day of the stats and the day after their last one:
+// the year given, or the last 12 months including the current one without a year
+func statsRange(year string, now time.Time) (time.Time, time.Time, error) {
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if year == "" {
+		return thisMonth.AddDate(0, -11, 0), thisMonth.AddDate(0, 1, 0), nil
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil || y < 1 || y > 9999 {
+		return thisMonth, thisMonth, fmt.Errorf("invalid year %q", year)
+	}
+	from := time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(1, 0, 0), nil
+}
+
+// savedPerMonth returns the months from from up to before to (but not after the current one)
+// as 2006-01 with the money saved in them: the magic number for every day of the month
+// so far plus the sum of its transactions, given by month
+func savedPerMonth(from, to, now time.Time, magicNumber float64, sums map[string]float64) ([]string, []float64) {
+	var labels []string
+	var values []float64
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for month := from; month.Before(to) && !month.After(today); month = month.AddDate(0, 1, 0) {
+		days := daysInMonth(month.Year(), month.Month())
+		if month.Year() == today.Year() && month.Month() == today.Month() {
+			days = today.Day()
+		}
+		key := month.Format("2006-01")
+		labels = append(labels, key)
+		values = append(values, float64(days)*magicNumber+sums[key])
+	}
+	return labels, values
+}
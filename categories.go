@@ -0,0 +1,178 @@
+/*
+This file holds the category tree - categories can be nested, like
+"Groceries" and "Restaurants" below "Food"
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// CategoryNode is a single category in the tree
+type CategoryNode struct {
+	ID     int
+	Name   string
+	Parent sql.NullInt64
+	Depth  int
+}
+
+// Indent returns a prefix to show the depth of the category in a flat list
+func (node CategoryNode) Indent() string {
+	return strings.Repeat("    ", node.Depth)
+}
+
+// ParentID returns the ID of the parent, 0 for top-level categories
+func (node CategoryNode) ParentID() int {
+	return int(node.Parent.Int64)
+}
+
+// sortTree orders the categories depth-first (parents before their children)
+// and sets their depth. The nodes have to be sorted by name.
+func sortTree(nodes []CategoryNode) []CategoryNode {
+	children := make(map[int64][]CategoryNode)
+	for _, node := range nodes {
+		children[node.Parent.Int64] = append(children[node.Parent.Int64], node)
+	}
+	var result []CategoryNode
+	var walk func(parent int64, depth int)
+	walk = func(parent int64, depth int) {
+		for _, node := range children[parent] {
+			node.Depth = depth
+			result = append(result, node)
+			walk(int64(node.ID), depth+1)
+		}
+	}
+	walk(0, 0)
+	return result
+}
+
+// categoryPaths returns the full path of every category, like "Food:Groceries"
+func categoryPaths(nodes []CategoryNode) map[string]string {
+	byID := make(map[int64]CategoryNode)
+	for _, node := range nodes {
+		byID[int64(node.ID)] = node
+	}
+	paths := make(map[string]string)
+	for _, node := range nodes {
+		path := []string{node.Name}
+		for parent := node.Parent; parent.Valid; parent = byID[parent.Int64].Parent {
+			path = append([]string{byID[parent.Int64].Name}, path...)
+			// Guard against a broken tree
+			if len(path) > len(nodes) {
+				break
+			}
+		}
+		paths[node.Name] = strings.Join(path, ":")
+	}
+	return paths
+}
+
+// isBelow checks whether the category id is the category ancestor or one of its descendants
+func isBelow(nodes []CategoryNode, id, ancestor int) bool {
+	byID := make(map[int]CategoryNode)
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	for steps := 0; steps <= len(nodes); steps++ {
+		if id == ancestor {
+			return true
+		}
+		node, ok := byID[id]
+		if !ok || !node.Parent.Valid {
+			return false
+		}
+		id = int(node.Parent.Int64)
+	}
+	return false
+}
+
+// moveCategory moves a category with all its sub-categories below a new parent
+// (0 moves it to the top). A category can't be moved below itself.
+func moveCategory(ctx context.Context, db *sql.DB, budget, id, parent int) error {
+	if parent == 0 {
+		return MoveCategory(ctx, db, budget, id, sql.NullInt64{})
+	}
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	known := false
+	for _, node := range nodes {
+		known = known || node.ID == parent
+	}
+	if !known {
+		return errors.New("unknown category")
+	}
+	if isBelow(nodes, parent, id) {
+		return errors.New("a category can't be moved below itself")
+	}
+	return MoveCategory(ctx, db, budget, id, ToNullInt64(parent))
+}
+
+// findCategory looks up a category by name
+func findCategory(nodes []CategoryNode, name string) (CategoryNode, bool) {
+	for _, node := range nodes {
+		if node.Name == name {
+			return node, true
+		}
+	}
+	return CategoryNode{}, false
+}
+
+// checkCategoryChange checks if a rename, merge or delete of the category name is possible.
+// target is the new name (rename) or the remaining category (merge).
+func checkCategoryChange(nodes []CategoryNode, action, name, target string) error {
+	if _, ok := findCategory(nodes, name); !ok {
+		return errors.New("unknown category " + name)
+	}
+	_, targetExists := findCategory(nodes, target)
+	switch action {
+	case "rename":
+		if strings.TrimSpace(target) == "" {
+			return errors.New("the new name is missing")
+		}
+		if targetExists {
+			return errors.New(target + " already exists - merge the categories instead")
+		}
+	case "merge":
+		if !targetExists {
+			return errors.New("unknown category " + target)
+		}
+		if target == name {
+			return errors.New("a category can't be merged with itself")
+		}
+	case "delete":
+	default:
+		return errors.New("unknown action " + action)
+	}
+	return nil
+}
+
+// changeCategory renames, merges or deletes the category name
+func changeCategory(ctx context.Context, db *sql.DB, budget int, user User, action, name, target string) error {
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	if err := checkCategoryChange(nodes, action, name, target); err != nil {
+		return err
+	}
+	switch action {
+	case "rename":
+		return RenameCategory(ctx, db, budget, user, name, strings.TrimSpace(target))
+	case "merge":
+		from, _ := findCategory(nodes, name)
+		into, _ := findCategory(nodes, target)
+		parent := into.Parent
+		if isBelow(nodes, into.ID, from.ID) {
+			parent = from.Parent
+		}
+		return MergeCategory(ctx, db, budget, user, name, target, parent)
+	case "delete":
+		return DeleteCategory(ctx, db, budget, user, name)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+This file holds the category suggestions - a naive Bayes classifier trained
+on the descriptions and amounts of the already categorized transactions.
+Everything is computed locally, nothing leaves the database.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Suggestion is a guessed category with the probability of it being right (0 to 1)
+type Suggestion struct {
+	Mapping    string
+	Confidence float64
+}
+
+// Percent returns the confidence for display, like "85%"
+func (s Suggestion) Percent() string {
+	return strconv.Itoa(int(s.Confidence*100+0.5)) + "%"
+}
+
+// classifier counts how often each feature (description token or amount bucket)
+// occurs in each category
+type classifier struct {
+	docs     int
+	catDocs  map[string]int
+	features map[string]map[string]int
+	catTotal map[string]int
+	vocab    map[string]bool
+	// average amount per description, for suggestions without a transaction at hand
+	amountSum   map[string]float64
+	amountCount map[string]int
+}
+
+// The limits of the amount buckets - small and large amounts tend to be
+// different kinds of expenses
+var amountBuckets = []float64{5, 10, 20, 50, 100, 200, 500, 1000, 5000}
+
+// features splits a transaction into its features: the lower-cased words
+// of the description, the amount bucket and whether it is an income
+func features(description string, amount float64) []string {
+	var result []string
+	words := strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if len(word) > 1 {
+			result = append(result, "w:"+word)
+		}
+	}
+	if amount > 0 {
+		result = append(result, "income")
+	} else {
+		amount = -amount
+	}
+	bucket := len(amountBuckets)
+	for i, limit := range amountBuckets {
+		if amount < limit {
+			bucket = i
+			break
+		}
+	}
+	return append(result, "a:"+string(rune('a'+bucket)))
+}
+
+// trainClassifier builds a classifier from all categorized transactions of a budget.
+// Every transaction counts, so frequent descriptions weigh more.
+func trainClassifier(ctx context.Context, db *sql.DB, budget int) (*classifier, error) {
+	entries, err := ReadJournal(ctx, db, budget)
+	if err != nil {
+		return nil, err
+	}
+	c := &classifier{catDocs: map[string]int{}, features: map[string]map[string]int{},
+		catTotal: map[string]int{}, vocab: map[string]bool{},
+		amountSum: map[string]float64{}, amountCount: map[string]int{}}
+	for _, item := range entries {
+		c.amountSum[item.Description] += item.Amount
+		c.amountCount[item.Description]++
+		if item.Mapping == "" {
+			continue
+		}
+		c.docs++
+		c.catDocs[item.Mapping]++
+		if c.features[item.Mapping] == nil {
+			c.features[item.Mapping] = map[string]int{}
+		}
+		for _, feature := range features(item.Description, item.Amount) {
+			c.features[item.Mapping][feature]++
+			c.catTotal[item.Mapping]++
+			c.vocab[feature] = true
+		}
+	}
+	return c, nil
+}
+
+// suggest returns the most probable category of a transaction.
+// ok is false if there is nothing to learn from yet.
+func (c *classifier) suggest(description string, amount float64) (Suggestion, bool) {
+	if c.docs == 0 {
+		return Suggestion{}, false
+	}
+	itemFeatures := features(description, amount)
+	// Log probabilities with Laplace smoothing
+	scores := make(map[string]float64)
+	best := ""
+	for mapping, count := range c.catDocs {
+		score := math.Log(float64(count) / float64(c.docs))
+		for _, feature := range itemFeatures {
+			score += math.Log(float64(c.features[mapping][feature]+1) / float64(c.catTotal[mapping]+len(c.vocab)))
+		}
+		scores[mapping] = score
+		if best == "" || score > scores[best] || (score == scores[best] && mapping < best) {
+			best = mapping
+		}
+	}
+	// Normalize into a probability
+	var sum float64
+	for _, score := range scores {
+		sum += math.Exp(score - scores[best])
+	}
+	return Suggestion{Mapping: best, Confidence: 1 / sum}, true
+}
+
+// suggestFor suggests a category for a description, using the average amount of its transactions
+func (c *classifier) suggestFor(description string) (Suggestion, bool) {
+	var amount float64
+	if count := c.amountCount[description]; count > 0 {
+		amount = c.amountSum[description] / float64(count)
+	}
+	return c.suggest(description, amount)
+}
+
+// suggestCategories suggests a category for every description without one
+func suggestCategories(ctx context.Context, db *sql.DB, budget int, cats []Category) (map[string]Suggestion, error) {
+	c, err := trainClassifier(ctx, db, budget)
+	if err != nil {
+		return nil, err
+	}
+	suggestions := make(map[string]Suggestion)
+	for _, cat := range cats {
+		if cat.Mapping.String != "" {
+			continue
+		}
+		if suggestion, ok := c.suggestFor(cat.Description); ok {
+			suggestions[cat.Description] = suggestion
+		}
+	}
+	return suggestions, nil
+}
@@ -0,0 +1,684 @@
+/*
+This file holds the command line interface - quick entry and reports
+without opening the browser. All commands work on the configured database.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// errUsage is returned by commands called with the wrong arguments
+var errUsage = errors.New("wrong arguments, see gofinance -h")
+
+// cliBudget is the budget the commands work on, see the -budget flag
+var cliBudget int
+
+// cliUser is who the audit log names for changes made with the commands
+var cliUser = User{Name: "command line"}
+
+// commands maps the command names to their implementation
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"serve":      serve,
+	"add":        cmdAdd,
+	"quick":      cmdQuick,
+	"today":      cmdToday,
+	"summary":    cmdSummary,
+	"categories": cmdCategories,
+	"tags":       cmdTags,
+	"split":      cmdSplit,
+	"share":      cmdShare,
+	"settle":     cmdSettle,
+	"activity":   cmdActivity,
+	"accounts":   cmdAccounts,
+	"transfer":   cmdTransfer,
+	"attach":     cmdAttach,
+	"backup":     cmdBackup,
+	"restore":    cmdRestore,
+	"users":      cmdUsers,
+	"budgets":    cmdBudgets,
+}
+
+// usage prints the help for the whole binary
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: gofinance [flags] [command]
+
+Commands:
+  serve                                   start the web server (default)
+  add [-income] [-tags <a,b>] [-account <name>] <amount> <description>
+                                          add a transaction
+  add -fixed [-income] -recurrence <monthly|quarterly|twice a year|yearly> <amount> <description>
+                                          add a fixed income/expense
+  quick [-y] <text>                       add a transaction like "12.50 lunch yesterday @food #work"
+  today                                   show today's magic number and expenses
+  summary week|month|year [tag]           show the expenses of the period, optionally only with a tag
+  categories                              list the categories of all descriptions
+  categories set <description> <category> categorize a description
+  categories suggest                      suggest categories for uncategorized descriptions
+  categories rename <category> <new name> rename a category everywhere
+  categories merge <category> <into>      merge a category into another one
+  categories delete <category>            delete a category, its descriptions become uncategorised
+  split <id> <amount> <category> <amount> <category>...
+                                          split a transaction into categories ("split <id>" removes the split)
+  share <id> <payer> equal <member>...    share a transaction equally ("share <id>" stops sharing)
+  share <id> <payer> percent|exact <member> <value> <member> <value>...
+                                          share a transaction by percentages or amounts
+  settle                                  show who owes whom and the payments to settle up
+  settle <from> <to> <amount>             record a payment between members
+  activity [count]                        show the latest changes from the audit log (default 20)
+  attach <id> <file>                      attach a receipt (image or PDF) to a transaction
+  accounts                                show the accounts with their balances
+  accounts add <name> <kind> [opening]    add an account (cash, checking, credit card or savings)
+  transfer <amount> <from> <to> [description]
+                                          move money between two accounts
+  tags [from] [to]                        show the totals per tag, dates as 2006-01-02
+  backup                                  write a backup into the backup directory
+  restore <backup>                        replace the database with a backup (stop the server first)
+  users                                   list the users
+  users add|passwd <name>                 add a user or change the password (asks for it)
+  users delete <name>                     delete a user
+  budgets                                 list the budgets with their members
+  budgets add <name> <owner>              start a budget owned by a user
+  budgets member <budget> <user> <role>   add a member or change the role (owner, editor or viewer)
+  budgets member <budget> <user> remove   take a member out of a budget
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+// cmdAdd stores a new transaction or fixed item - the same as the input forms
+func cmdAdd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	income := flags.Bool("income", false, "the amount is an income")
+	fixed := flags.Bool("fixed", false, "add a fixed income/expense instead of a transaction")
+	recurrence := flags.String("recurrence", "monthly", "recurrence of a fixed item: monthly, quarterly, twice a year or yearly")
+	tags := flags.String("tags", "", "comma separated tags of the transaction")
+	account := flags.String("account", "", "name of the account of the transaction (default the first one)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return errUsage
+	}
+	amount, err := strconv.ParseFloat(flags.Arg(0), 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %q", flags.Arg(0))
+	}
+	description := strings.Join(flags.Args()[1:], " ")
+	if !*fixed {
+		var accountID int
+		if *account != "" {
+			if accountID = findAccount(ctx, db, cliBudget, *account); accountID == 0 {
+				return fmt.Errorf("unknown account %q", *account)
+			}
+		}
+		_, err := StoreItem(ctx, db, cliBudget, cliUser, Transaction{Description: description, Amount: amount, Income: *income, Tags: parseTags(*tags), Account: accountID}, "transaction")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s: %.2f\n", description, amount)
+		return nil
+	}
+	rec := strings.ToLower(*recurrence)
+	switch rec {
+	case "monthly", "quarterly", "twice a year", "yearly":
+	default:
+		return fmt.Errorf("invalid recurrence %q", *recurrence)
+	}
+	influence := calcRate(Transaction{Recurrence: rec, Amount: amount, Income: *income})
+	_, err = StoreItem(ctx, db, cliBudget, cliUser, Transaction{Description: description, Amount: amount, Income: *income, Recurrence: rec, Influence: influence}, "fixed")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s: %.2f %s (%.2f per day)\n", description, amount, rec, influence)
+	return nil
+}
+
+// cmdQuick parses a quick-add line, shows its interpretation and
+// saves it after confirmation (or right away with -y)
+func cmdQuick(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("quick", flag.ContinueOnError)
+	yes := flags.Bool("y", false, "save without asking")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	quick, err := parseQuickAdd(strings.Join(flags.Args(), " "), time.Now())
+	if err != nil {
+		return err
+	}
+	kind := "Expense"
+	if quick.Income {
+		kind = "Income"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\t%s\n", kind, quick.Description)
+	fmt.Fprintf(w, "Amount\t%.2f %s\n", quick.Amount, currency)
+	fmt.Fprintf(w, "Date\t%s\n", quick.Date())
+	if quick.Category != "" {
+		fmt.Fprintf(w, "Category\t%s\n", quick.Category)
+	}
+	if len(quick.Tags) > 0 {
+		fmt.Fprintf(w, "Tags\t%s\n", strings.Join(quick.Tags, ", "))
+	}
+	w.Flush()
+	if !*yes {
+		fmt.Print("Save? [Y/n] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "" && answer != "y" && answer != "yes" {
+			fmt.Println("Not saved")
+			return nil
+		}
+	}
+	if err := storeQuickAdd(ctx, cliBudget, cliUser, quick); err != nil {
+		return err
+	}
+	fmt.Println("Saved")
+	return nil
+}
+
+// cmdToday prints the same as the "Today's expenses" panel of the main page
+func cmdToday(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	items, err := ReadItem(ctx, db, cliBudget, "transaction")
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%.2f %s\t\n", item.Description, item.Amount, currency)
+	}
+	magicNumber, err := baseMagic(ctx, db, cliBudget)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Rate for Today\t%.2f %s\t\n", magicNumber, currency)
+	total, err := currentMagic(ctx, db, cliBudget)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Total\t%.2f %s\t\n", total, currency)
+	return w.Flush()
+}
+
+// cmdSummary prints the transactions of the week, month or year - like the summary pages.
+// With a tag only the transactions with that tag are shown and summed up.
+func cmdSummary(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	period, tag := args[0], ""
+	switch period {
+	case "week", "month", "year":
+	default:
+		return errUsage
+	}
+	if len(args) == 2 {
+		tag = normalizeTag(args[1])
+	}
+	entries, err := SumSummary(ctx, db, cliBudget, period, tag)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	var tagged float64
+	for _, item := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%10.2f %s\n", item.Date, item.Mapping, item.Description, item.Amount, currency)
+		tagged += item.Amount
+	}
+	if tag != "" {
+		fmt.Fprintf(w, "\t\tTotal #%s\t%10.2f %s\n", tag, tagged, currency)
+		return w.Flush()
+	}
+	total, err := expensesPerPeriod(ctx, cliBudget, period)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\t\tTotal\t%10.2f %s\n", total, currency)
+	return w.Flush()
+}
+
+// cmdTags prints the totals per tag, like the tags page
+func cmdTags(ctx context.Context, args []string) error {
+	if len(args) > 2 {
+		return errUsage
+	}
+	var dates [2]string
+	for i, arg := range args {
+		if _, err := time.Parse("2006-01-02", arg); err != nil {
+			return fmt.Errorf("invalid date %q", arg)
+		}
+		dates[i] = arg
+	}
+	totals, err := SumTags(ctx, db, cliBudget, dates[0], dates[1])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, item := range totals {
+		fmt.Fprintf(w, "#%s\t%d\t%.2f %s\t\n", item.Name, item.Count, item.Total(), currency)
+	}
+	return w.Flush()
+}
+
+// cmdCategories lists the categories, suggests missing ones, categorizes a description
+// or renames, merges and deletes categories
+func cmdCategories(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		cats, err := getCategories(ctx, db, cliBudget)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, cat := range cats {
+			fmt.Fprintf(w, "%s\t%s\n", cat.Description, cat.Mapping.String)
+		}
+		return w.Flush()
+	}
+	if len(args) == 1 && args[0] == "suggest" {
+		cats, err := getCategories(ctx, db, cliBudget)
+		if err != nil {
+			return err
+		}
+		suggestions, err := suggestCategories(ctx, db, cliBudget, cats)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, cat := range cats {
+			if suggestion, ok := suggestions[cat.Description]; ok {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", cat.Description, suggestion.Mapping, suggestion.Percent())
+			}
+		}
+		return w.Flush()
+	}
+	switch {
+	case len(args) == 3 && (args[0] == "rename" || args[0] == "merge"):
+		usage := ReadCategoryUsage(ctx, db, cliBudget, args[1])
+		if err := changeCategory(ctx, db, cliBudget, cliUser, args[0], args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d transactions in %d descriptions changed\n", args[0], usage.Transactions, usage.Descriptions)
+		return nil
+	case len(args) == 2 && args[0] == "delete":
+		usage := ReadCategoryUsage(ctx, db, cliBudget, args[1])
+		if err := changeCategory(ctx, db, cliBudget, cliUser, "delete", args[1], ""); err != nil {
+			return err
+		}
+		fmt.Printf("delete: %d transactions in %d descriptions are uncategorised now\n", usage.Transactions, usage.Descriptions)
+		return nil
+	}
+	if len(args) != 3 || args[0] != "set" {
+		return errUsage
+	}
+	if err := setMapping(ctx, db, cliBudget, cliUser, args[1], args[2]); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now categorized as %s\n", args[1], args[2])
+	return nil
+}
+
+// cmdSplit divides a transaction into parts with their own category
+func cmdSplit(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid transaction %q", args[0])
+	}
+	var amounts, mappings []string
+	for i := 1; i < len(args); i += 2 {
+		amounts = append(amounts, args[i])
+		mappings = append(mappings, args[i+1])
+	}
+	splits, err := parseSplits(amounts, mappings)
+	if err != nil {
+		return err
+	}
+	if err := splitTransaction(ctx, db, cliBudget, cliUser, id, splits); err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %d split into %d parts\n", id, len(splits))
+	return nil
+}
+
+// cmdShare sets who paid a transaction and divides it among members
+func cmdShare(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) < 4 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid transaction %q", args[0])
+	}
+	if len(args) == 1 {
+		if err := shareTransaction(ctx, db, cliBudget, cliUser, id, "", nil); err != nil {
+			return err
+		}
+		fmt.Printf("Transaction %d isn't shared anymore\n", id)
+		return nil
+	}
+	var names, values []string
+	switch args[2] {
+	case "equal":
+		names = args[3:]
+		values = make([]string, len(names))
+	case "percent", "exact":
+		if len(args)%2 != 1 {
+			return errUsage
+		}
+		for i := 3; i < len(args); i += 2 {
+			names = append(names, args[i])
+			values = append(values, args[i+1])
+		}
+	default:
+		return errUsage
+	}
+	item, err := getSingle(ctx, db, cliBudget, id, "transactions")
+	if err != nil {
+		return err
+	}
+	shares, err := parseShares(args[2], item.Amount, names, values)
+	if err != nil {
+		return err
+	}
+	if err := shareTransaction(ctx, db, cliBudget, cliUser, id, args[1], shares); err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %d paid by %s and shared among %d members\n", id, args[1], len(shares))
+	return nil
+}
+
+// cmdSettle prints the balances of the members with the payments to settle up, or records a payment
+func cmdSettle(ctx context.Context, args []string) error {
+	if len(args) == 3 {
+		if err := recordSettlement(ctx, db, cliBudget, args[0], args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("%s paid %s to %s\n", args[0], args[2], args[1])
+		return nil
+	}
+	if len(args) != 0 {
+		return errUsage
+	}
+	balances, err := ReadBalances(ctx, db, cliBudget)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, item := range balances {
+		fmt.Fprintf(w, "%s\t%.2f %s\t\n", item.Name, item.Amount, currency)
+	}
+	for _, item := range settleUp(balances) {
+		fmt.Fprintf(w, "%s pays %s\t%.2f %s\t\n", item.From.Name, item.To.Name, item.Amount, currency)
+	}
+	return w.Flush()
+}
+
+// cmdActivity prints the latest changes of the budget from the audit log, newest first
+func cmdActivity(ctx context.Context, args []string) error {
+	count := 20
+	if len(args) > 1 {
+		return errUsage
+	}
+	if len(args) == 1 {
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count <= 0 {
+			return fmt.Errorf("invalid count %q", args[0])
+		}
+	}
+	entries, err := ReadAudit(ctx, db, cliBudget, "", 0, 0, count)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s %s %d\t%s\t\n", entry.Time, entry.User, entry.Action, entry.Kind, entry.ItemID, entry.Description())
+		for _, change := range entry.Changes() {
+			if entry.Action == "insert" {
+				fmt.Fprintf(w, "\t\t  %s\t%s\t\n", change.Field, change.New)
+			} else {
+				fmt.Fprintf(w, "\t\t  %s\t%s -> %s\t\n", change.Field, change.Old, change.New)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// cmdAccounts lists the accounts with their balances, or adds a new one
+func cmdAccounts(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		accounts, err := ReadAccounts(ctx, db, cliBudget)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+		var total float64
+		for _, item := range accounts {
+			fmt.Fprintf(w, "%s\t%s\t%.2f %s\t\n", item.Name, item.Kind, item.Balance, currency)
+			total += item.Balance
+		}
+		fmt.Fprintf(w, "Total\t\t%.2f %s\t\n", total, currency)
+		return w.Flush()
+	}
+	if args[0] != "add" || len(args) < 3 || len(args) > 4 {
+		return errUsage
+	}
+	var opening string
+	if len(args) == 4 {
+		opening = args[3]
+	}
+	item, err := parseAccount(args[1], args[2], opening)
+	if err != nil {
+		return err
+	}
+	if _, err := saveAccount(ctx, db, cliBudget, item); err != nil {
+		return err
+	}
+	fmt.Printf("Added account %s\n", item.Name)
+	return nil
+}
+
+// cmdTransfer moves money between two accounts, given by name
+func cmdTransfer(ctx context.Context, args []string) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+	amount, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %q", args[0])
+	}
+	item := Transfer{Amount: amount, From: findAccount(ctx, db, cliBudget, args[1]), To: findAccount(ctx, db, cliBudget, args[2]),
+		Description: strings.Join(args[3:], " ")}
+	for i, id := range []int{item.From, item.To} {
+		if id == 0 {
+			return fmt.Errorf("unknown account %q", args[i+1])
+		}
+	}
+	if err := transferMoney(ctx, db, cliBudget, cliUser, item); err != nil {
+		return err
+	}
+	fmt.Printf("Transferred %.2f from %s to %s\n", amount, args[1], args[2])
+	return nil
+}
+
+// cmdAttach attaches a file to a transaction - with the same checks as an upload
+func cmdAttach(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid transaction %q", args[0])
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, contentType, err := readUpload(file, *attachmentMaxSize)
+	if err != nil {
+		return err
+	}
+	if err := attachFile(ctx, db, cliBudget, cliUser, *attachmentDir, id, args[1], data, contentType); err != nil {
+		return err
+	}
+	fmt.Printf("Attached %s (%s) to transaction %d\n", args[1], contentType, id)
+	return nil
+}
+
+// cmdBackup writes a backup right away - works while the server is running
+func cmdBackup(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	path, err := backupNow(ctx, db, *backupDir, *attachmentDir, *backupKeep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Backup written to", path)
+	return nil
+}
+
+// cmdRestore swaps a backup in as the database
+func cmdRestore(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if err := restoreBackup(ctx, args[0], *dbpath, *attachmentDir); err != nil {
+		return err
+	}
+	fmt.Println("Restored", args[0], "to", *dbpath)
+	return nil
+}
+
+// cmdUsers lists, adds and deletes the users who can sign in, or changes a password
+func cmdUsers(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		users, err := ReadUsers(ctx, db)
+		for _, user := range users {
+			fmt.Println(user.Name)
+		}
+		return err
+	}
+	if len(args) != 2 {
+		return errUsage
+	}
+	switch args[0] {
+	case "add", "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if args[0] == "add" {
+			err = addUser(ctx, db, args[1], password)
+		} else {
+			err = setPassword(ctx, db, args[1], password)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Saved the password of", args[1])
+		return nil
+	case "delete":
+		return removeUser(ctx, db, args[1])
+	}
+	return errUsage
+}
+
+// cmdBudgets lists the budgets with their members, starts a budget or
+// manages its members
+func cmdBudgets(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		budgets, err := readAllBudgets(ctx, db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, budget := range budgets {
+			list, err := ReadMembers(ctx, db, budget.ID)
+			if err != nil {
+				return err
+			}
+			var members []string
+			for _, member := range list {
+				members = append(members, member.Name+" ("+member.Role+")")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", budget.ID, budget.Name, strings.Join(members, ", "))
+		}
+		return w.Flush()
+	}
+	switch {
+	case len(args) == 3 && args[0] == "add":
+		owner, _, err := ReadUser(ctx, db, args[2])
+		if err != nil {
+			return err
+		}
+		if owner.ID == 0 {
+			return fmt.Errorf("unknown user %q", args[2])
+		}
+		id, err := createBudget(ctx, db, owner.ID, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added budget %s (%d)\n", args[1], id)
+		return nil
+	case len(args) == 4 && args[0] == "member":
+		budget, err := findBudget(ctx, db, args[1])
+		if err != nil {
+			return err
+		}
+		if args[3] == "remove" {
+			err = removeMember(ctx, db, budget, args[2])
+		} else {
+			err = setMemberRole(ctx, db, budget, args[2], args[3])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Saved the members of %s\n", args[1])
+		return nil
+	}
+	return errUsage
+}
+
+// readPassword asks for a password twice without showing it - or reads a
+// single line if the input is not a terminal, for scripts
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	var passwords [2]string
+	for i, prompt := range []string{"Password: ", "Again: "} {
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passwords[i] = string(password)
+	}
+	if passwords[0] != passwords[1] {
+		return "", errors.New("the passwords don't match")
+	}
+	return passwords[0], nil
+}
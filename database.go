@@ -5,13 +5,28 @@ like creation, insertion and reading
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// The version of the database layout, stored as "PRAGMA user_version".
+// Backups are only restored if their version is known to this build.
+const schemaVersion = 12
+
+// The category shown for transactions without a category
+const uncategorised = "Uncategorised"
+
+// itemTypes are the tables of the items that can be edited, as in /edit/<type>/<id>
+var itemTypes = map[string]bool{"fixed": true, "transactions": true}
+
 // Transaction Basic struct
 // Holds all information of a single transaction to interact (write and read) entries
 // from the database.
@@ -23,6 +38,12 @@ type Transaction struct {
 	Recurrence  string
 	Influence   float64
 	Timestamp   time.Time
+	Tags        []string
+	Splits      []Split
+	Note        string
+	Account     int
+	PaidBy      int
+	Shares      []Share
 }
 
 // Category basic struct
@@ -36,10 +57,13 @@ type Category struct {
 // Single Entry struct
 // Represents a single entry
 type Entry struct {
+	ID          int
 	Date        string
 	Mapping     string
 	Description string
 	Amount      float64
+	Tags        []string
+	Splits      []Split
 }
 
 // ToNullInt64 helper to convert from regular int into float64
@@ -72,7 +96,7 @@ func initDB(filepath string) *sql.DB {
 }
 
 // CreateTable to creates the database, if it not already exists
-func CreateTable(db *sql.DB) {
+func CreateTable(ctx context.Context, db *sql.DB) {
 	// Create if not exists
 	sqlTable := `
   CREATE TABLE IF NOT EXISTS fixed(
@@ -85,7 +109,7 @@ func CreateTable(db *sql.DB) {
     timestamp DATETIME
     );
     `
-	_, err := db.Exec(sqlTable)
+	_, err := db.ExecContext(ctx, sqlTable)
 	if err != nil {
 		panic(err)
 	}
@@ -99,7 +123,7 @@ func CreateTable(db *sql.DB) {
     timestamp DATETIME
     );
     `
-	_, err2 := db.Exec(sqlTable2)
+	_, err2 := db.ExecContext(ctx, sqlTable2)
 	if err2 != nil {
 		panic(err2)
 	}
@@ -110,122 +134,666 @@ func CreateTable(db *sql.DB) {
     description TEXT
     );
     `
-	_, err3 := db.Exec(sqlTable3)
+	_, err3 := db.ExecContext(ctx, sqlTable3)
 	if err3 != nil {
 		panic(err3)
 	}
+	sqlTable4 := `
+  CREATE TABLE IF NOT EXISTS rules(
+    id INTEGER NOT NULL PRIMARY KEY,
+    priority INTEGER,
+    kind TEXT,
+    pattern TEXT,
+    min REAL,
+    max REAL,
+    mapping TEXT
+    );
+    `
+	_, err4 := db.ExecContext(ctx, sqlTable4)
+	if err4 != nil {
+		panic(err4)
+	}
+	// The category tree - mappings refer to the categories by name
+	sqlTable5 := `
+  CREATE TABLE IF NOT EXISTS categories(
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    parent INTEGER REFERENCES categories(id)
+    );
+    `
+	_, err5 := db.ExecContext(ctx, sqlTable5)
+	if err5 != nil {
+		panic(err5)
+	}
+	// Tags belong to single transactions, not to descriptions
+	sqlTable6 := `
+  CREATE TABLE IF NOT EXISTS tags(
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+    );
+  CREATE TABLE IF NOT EXISTS transaction_tags(
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    tag_id INTEGER NOT NULL REFERENCES tags(id),
+    PRIMARY KEY (transaction_id, tag_id)
+    );
+    `
+	_, err6 := db.ExecContext(ctx, sqlTable6)
+	if err6 != nil {
+		panic(err6)
+	}
+	// A split transaction is categorized by its parts instead of its description
+	sqlTable7 := `
+  CREATE TABLE IF NOT EXISTS splits(
+    id INTEGER NOT NULL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    amount REAL,
+    mapping TEXT
+    );
+    `
+	_, err7 := db.ExecContext(ctx, sqlTable7)
+	if err7 != nil {
+		panic(err7)
+	}
+	// Notes and receipts - the files are either stored in the attachment directory
+	// (path) or right here (data)
+	addColumn(ctx, db, "transactions", "note", "TEXT")
+	sqlTable8 := `
+  CREATE TABLE IF NOT EXISTS attachments(
+    id INTEGER NOT NULL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    filename TEXT,
+    content_type TEXT,
+    size INTEGER,
+    path TEXT,
+    data BLOB,
+    created DATETIME
+    );
+    `
+	_, err8 := db.ExecContext(ctx, sqlTable8)
+	if err8 != nil {
+		panic(err8)
+	}
+	// Accounts with their opening balance. Transfers move money between two accounts -
+	// they are kept apart from the transactions, so they never count as income or expense.
+	// Transactions from before the accounts existed belong to the first one (see below).
+	sqlTable9 := `
+  CREATE TABLE IF NOT EXISTS accounts(
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    kind TEXT NOT NULL,
+    opening REAL NOT NULL DEFAULT 0
+    );
+  CREATE TABLE IF NOT EXISTS transfers(
+    id INTEGER NOT NULL PRIMARY KEY,
+    from_account INTEGER NOT NULL REFERENCES accounts(id),
+    to_account INTEGER NOT NULL REFERENCES accounts(id),
+    amount REAL,
+    description TEXT,
+    timestamp DATETIME
+    );
+    `
+	_, err9 := db.ExecContext(ctx, sqlTable9)
+	if err9 != nil {
+		panic(err9)
+	}
+	addColumn(ctx, db, "transactions", "account", "INTEGER REFERENCES accounts(id)")
+	// Reconciliations with the bank statements. A clearing marks a transaction or one side
+	// of a transfer as cleared on an account - locked once it belongs to a reconciliation.
+	sqlTable12 := `
+  CREATE TABLE IF NOT EXISTS reconciliations(
+    id INTEGER NOT NULL PRIMARY KEY,
+    account INTEGER NOT NULL REFERENCES accounts(id),
+    statement_date TEXT,
+    closing REAL,
+    created DATETIME
+    );
+  CREATE TABLE IF NOT EXISTS clearings(
+    account INTEGER NOT NULL REFERENCES accounts(id),
+    transaction_id INTEGER NOT NULL DEFAULT 0,
+    transfer_id INTEGER NOT NULL DEFAULT 0,
+    reconciliation_id INTEGER REFERENCES reconciliations(id),
+    PRIMARY KEY (account, transaction_id, transfer_id)
+    );
+    `
+	_, err12 := db.ExecContext(ctx, sqlTable12)
+	if err12 != nil {
+		panic(err12)
+	}
+	// Users sign in with a password (only its bcrypt hash is stored). Sessions are
+	// kept by the SHA-256 of their token, so the database alone doesn't allow to log in.
+	sqlTable14 := `
+  CREATE TABLE IF NOT EXISTS users(
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    password TEXT,
+    created DATETIME
+    );
+  CREATE TABLE IF NOT EXISTS sessions(
+    token TEXT NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    created DATETIME,
+    expires DATETIME
+    );
+    `
+	_, err14 := db.ExecContext(ctx, sqlTable14)
+	if err14 != nil {
+		panic(err14)
+	}
+	// Budgets (households) own the transactions, fixed items, categories, rules, tags and
+	// accounts - everything else belongs to one of those. Users are members of budgets with
+	// a role. Everything from before the budgets belongs to the first one, and so do its users.
+	sqlTable16 := `
+  CREATE TABLE IF NOT EXISTS budgets(
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    created DATETIME
+    );
+  INSERT INTO budgets (name, created) SELECT 'Household', CURRENT_TIMESTAMP WHERE NOT EXISTS (SELECT 1 FROM budgets);
+  CREATE TABLE IF NOT EXISTS budget_members(
+    budget_id INTEGER NOT NULL REFERENCES budgets(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    role TEXT NOT NULL,
+    PRIMARY KEY (budget_id, user_id)
+    );
+    `
+	_, err16 := db.ExecContext(ctx, sqlTable16)
+	if err16 != nil {
+		panic(err16)
+	}
+	if !hasColumn(ctx, db, "categories", "budget") {
+		_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO budget_members (budget_id, user_id, role) SELECT (SELECT MIN(id) FROM budgets), id, 'owner' FROM users")
+		if err != nil {
+			panic(err)
+		}
+		moveIntoBudgets(ctx, db)
+	}
+	for _, table := range []string{"fixed", "transactions", "mappings", "rules"} {
+		addColumn(ctx, db, table, "budget", "INTEGER REFERENCES budgets(id)")
+		_, err := db.ExecContext(ctx, "UPDATE "+table+" SET budget = (SELECT MIN(id) FROM budgets) WHERE budget IS NULL")
+		if err != nil {
+			panic(err)
+		}
+	}
+	// Every budget has an account and every transaction one of its budget. The postings are
+	// what the category sums are built from: the parts of the split transactions (with the sign
+	// of their transaction) and all other transactions as a whole.
+	sqlTable17 := `
+  INSERT INTO accounts (budget, name, kind)
+    SELECT id, 'Cash', 'cash' FROM budgets WHERE id NOT IN (SELECT budget FROM accounts);
+  UPDATE transactions SET account = (SELECT MIN(id) FROM accounts WHERE accounts.budget = transactions.budget)
+    WHERE account IS NULL;
+  INSERT OR IGNORE INTO categories (budget, name)
+    SELECT DISTINCT budget, mapping FROM mappings WHERE mapping IS NOT NULL AND mapping != '';
+  DROP VIEW IF EXISTS postings;
+  CREATE VIEW postings AS
+    SELECT transactions.id AS transaction_id, transactions.amount AS amount, mappings.mapping AS mapping
+      FROM transactions LEFT JOIN mappings USING (description, budget)
+      WHERE transactions.id NOT IN (SELECT transaction_id FROM splits)
+    UNION ALL
+    SELECT transaction_id, CASE WHEN transactions.amount < 0 THEN -splits.amount ELSE splits.amount END, splits.mapping
+      FROM splits JOIN transactions ON transactions.id = splits.transaction_id;
+    `
+	_, err17 := db.ExecContext(ctx, sqlTable17)
+	if err17 != nil {
+		panic(err17)
+	}
+	// Shared transactions are paid by one member and divided among several, the
+	// settlements are the payments between members to even out their balances
+	addColumn(ctx, db, "transactions", "paid_by", "INTEGER REFERENCES users(id)")
+	sqlTable18 := `
+  CREATE TABLE IF NOT EXISTS shares(
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    amount REAL NOT NULL,
+    PRIMARY KEY (transaction_id, user_id)
+    );
+  CREATE TABLE IF NOT EXISTS settlements(
+    id INTEGER NOT NULL PRIMARY KEY,
+    budget INTEGER NOT NULL REFERENCES budgets(id),
+    from_user INTEGER NOT NULL REFERENCES users(id),
+    to_user INTEGER NOT NULL REFERENCES users(id),
+    amount REAL NOT NULL,
+    timestamp DATETIME
+    );
+    `
+	_, err18 := db.ExecContext(ctx, sqlTable18)
+	if err18 != nil {
+		panic(err18)
+	}
+	// The audit log keeps every change of the transactions, fixed items and categorizations,
+	// with who made it and the values before and after (as JSON). It is append-only.
+	sqlTable19 := `
+  CREATE TABLE IF NOT EXISTS audit(
+    id INTEGER NOT NULL PRIMARY KEY,
+    budget INTEGER NOT NULL REFERENCES budgets(id),
+    timestamp DATETIME NOT NULL,
+    user_id INTEGER,
+    user_name TEXT NOT NULL,
+    action TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    item_id INTEGER NOT NULL,
+    old TEXT,
+    new TEXT
+    );
+  CREATE INDEX IF NOT EXISTS audit_item ON audit (kind, item_id);
+  CREATE TRIGGER IF NOT EXISTS audit_no_update BEFORE UPDATE ON audit
+    BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
+  CREATE TRIGGER IF NOT EXISTS audit_no_delete BEFORE DELETE ON audit
+    BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
+    `
+	_, err19 := db.ExecContext(ctx, sqlTable19)
+	if err19 != nil {
+		panic(err19)
+	}
+	_, err15 := db.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	if err15 != nil {
+		panic(err15)
+	}
+}
+
+// addColumn adds a column to an existing table, unless it is already there
+func addColumn(ctx context.Context, db *sql.DB, table, column, definition string) {
+	if hasColumn(ctx, db, table, column) {
+		return
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// hasColumn checks whether a table has a column
+func hasColumn(ctx context.Context, db *sql.DB, table, column string) bool {
+	var count int
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	if err := row.Scan(&count); err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+// moveIntoBudgets gives the categories, tags and accounts a budget. Their names are only
+// unique within a budget now - SQLite can't change the constraint, so the tables are rebuilt.
+func moveIntoBudgets(ctx context.Context, db *sql.DB) {
+	sqlRebuild := `
+  CREATE TABLE categories_new(
+    id INTEGER NOT NULL PRIMARY KEY,
+    budget INTEGER NOT NULL REFERENCES budgets(id),
+    name TEXT NOT NULL,
+    parent INTEGER REFERENCES categories(id),
+    UNIQUE (budget, name)
+    );
+  INSERT INTO categories_new (id, budget, name, parent) SELECT id, (SELECT MIN(id) FROM budgets), name, parent FROM categories;
+  DROP TABLE categories;
+  ALTER TABLE categories_new RENAME TO categories;
+  CREATE TABLE tags_new(
+    id INTEGER NOT NULL PRIMARY KEY,
+    budget INTEGER NOT NULL REFERENCES budgets(id),
+    name TEXT NOT NULL,
+    UNIQUE (budget, name)
+    );
+  INSERT INTO tags_new (id, budget, name) SELECT id, (SELECT MIN(id) FROM budgets), name FROM tags;
+  DROP TABLE tags;
+  ALTER TABLE tags_new RENAME TO tags;
+  CREATE TABLE accounts_new(
+    id INTEGER NOT NULL PRIMARY KEY,
+    budget INTEGER NOT NULL REFERENCES budgets(id),
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    opening REAL NOT NULL DEFAULT 0,
+    UNIQUE (budget, name)
+    );
+  INSERT INTO accounts_new (id, budget, name, kind, opening) SELECT id, (SELECT MIN(id) FROM budgets), name, kind, opening FROM accounts;
+  DROP TABLE accounts;
+  ALTER TABLE accounts_new RENAME TO accounts;
+    `
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, sqlRebuild); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+}
+
+// readSchemaVersion returns the layout version of a database (0 for databases
+// created before versioning was introduced)
+func readSchemaVersion(ctx context.Context, db *sql.DB) int {
+	var version int
+	row := db.QueryRowContext(ctx, "PRAGMA user_version")
+	_ = row.Scan(&version)
+	return version
 }
 
+// sqlTagList selects the comma separated tags of a transaction
+const sqlTagList = "(SELECT GROUP_CONCAT(name) FROM (SELECT name FROM transaction_tags JOIN tags ON tags.id = transaction_tags.tag_id WHERE transaction_id = transactions.id ORDER BY name))"
+
+// sqlTagFilter limits a query to the transactions with a tag, or keeps all of them
+// if the tag is empty. It takes the tag twice as argument.
+const sqlTagFilter = " AND (? = '' OR transactions.id IN (SELECT transaction_id FROM transaction_tags JOIN tags ON tags.id = transaction_tags.tag_id WHERE tags.name = ?))"
+
 // SumSummary is responsible for summing up all values for a specific period (week,
 // month or year) to display in the summary panel on the front page.
-func SumSummary(db *sql.DB, period string) []Entry {
-	var sqlQuery string
+// A tag limits the summary to the transactions with that tag.
+func SumSummary(ctx context.Context, db *sql.DB, budget int, period, tag string) ([]Entry, error) {
+	var since string
 	switch period {
 	case "week":
-		sqlQuery = "SELECT strftime('%Y-%m-%d', timestamp) as time, mapping, description, amount FROM transactions JOIN mappings USING (description) WHERE timestamp >= date('now', 'weekday 0', '-6 days') ORDER BY time"
+		since = "date('now', 'weekday 0', '-6 days')"
 	case "month":
-		sqlQuery = "SELECT strftime('%Y-%m-%d', timestamp) as time, mapping, description, amount FROM transactions JOIN mappings USING (description) WHERE timestamp >= date('now', 'start of month') ORDER BY time"
+		since = "date('now', 'start of month')"
 	case "year":
-		sqlQuery = "SELECT strftime('%Y-%m-%d', timestamp) as time, mapping, description, amount FROM transactions JOIN mappings USING (description) WHERE timestamp >= date('now', 'start of year') ORDER BY time"
+		since = "date('now', 'start of year')"
+	default:
+		return nil, nil
+	}
+	sqlQuery := "SELECT strftime('%Y-%m-%d', timestamp) as time, COALESCE(NULLIF(postings.mapping, ''), ?), description, postings.amount, " + sqlTagList + " FROM transactions JOIN postings ON postings.transaction_id = transactions.id WHERE transactions.budget = ? AND timestamp >= " + since + sqlTagFilter + " ORDER BY time"
+	var entries []Entry
+	rows, err := db.QueryContext(ctx, sqlQuery, uncategorised, budget, tag, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item Entry
+		var tags sql.NullString
+		if err := rows.Scan(&item.Date, &item.Mapping, &item.Description, &item.Amount, &tags); err != nil {
+			return nil, err
+		}
+		item.Tags = splitTags(tags)
+		entries = append(entries, item)
+	}
+	return entries, rows.Err()
+}
+
+// sqlSubtree selects the names of a category and all of its descendants.
+// It takes the budget and the name of the category as arguments.
+const sqlSubtree = `WITH RECURSIVE subtree(id, name) AS (
+	SELECT id, name FROM categories WHERE budget = ? AND name = ?
+	UNION ALL
+	SELECT categories.id, categories.name FROM categories JOIN subtree ON categories.parent = subtree.id)
+	`
+
+// sqlRoots selects every category of a budget (the argument) with the name of its top-level category (root)
+const sqlRoots = `WITH RECURSIVE roots(id, name, root) AS (
+	SELECT id, name, name FROM categories WHERE budget = ? AND parent IS NULL
+	UNION ALL
+	SELECT categories.id, categories.name, roots.root FROM categories JOIN roots ON categories.parent = roots.id)
+	`
+
+// SumMonthlyByRoot sums up the transactions per month ("2006-01" in Date) and top-level category,
+// from the first day up to (but without) the last one
+func SumMonthlyByRoot(ctx context.Context, db *sql.DB, budget int, from, to string) ([]Entry, error) {
+	sqlQuery := sqlRoots + `SELECT COALESCE(root, ?) AS rootname, strftime('%Y-%m', timestamp) AS month, SUM(postings.amount)
+	FROM transactions JOIN postings ON postings.transaction_id = transactions.id
+	LEFT JOIN roots ON roots.name = postings.mapping
+	WHERE transactions.budget = ? AND date(timestamp) >= ? AND date(timestamp) < ?
+	GROUP BY rootname, month ORDER BY month, rootname`
+	rows, err := db.QueryContext(ctx, sqlQuery, budget, uncategorised, budget, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var item Entry
+		if err := rows.Scan(&item.Mapping, &item.Date, &item.Amount); err != nil {
+			return nil, err
+		}
+		entries = append(entries, item)
+	}
+	return entries, rows.Err()
+}
+
+// SumByCats sums up the transactions of a category (including its sub-categories) per description.
+// The parts of split transactions count in their own category.
+// A tag limits the sums to the transactions with that tag.
+func SumByCats(ctx context.Context, db *sql.DB, budget int, category, tag string) ([]Entry, error) {
+	sqlQuery := sqlSubtree + "SELECT strftime('%Y-%m-%d', timestamp), postings.mapping, description, sum(postings.amount) FROM transactions JOIN postings ON postings.transaction_id = transactions.id WHERE postings.mapping IN (SELECT name FROM subtree) AND transactions.budget = ? AND timestamp >= date('now', 'start of year')" + sqlTagFilter + " GROUP BY description, postings.mapping"
+	args := []interface{}{budget, category, budget, tag, tag}
+	if category == uncategorised {
+		sqlQuery = "SELECT strftime('%Y-%m-%d', timestamp), ?, description, sum(postings.amount) FROM transactions JOIN postings ON postings.transaction_id = transactions.id WHERE COALESCE(postings.mapping, '') = '' AND transactions.budget = ? AND timestamp >= date('now', 'start of year')" + sqlTagFilter + " GROUP BY description"
+		args = args[1:]
+	}
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 	var entries []Entry
-	rows, _ := db.Query(sqlQuery)
 	for rows.Next() {
 		var item Entry
-		_ = rows.Scan(&item.Date, &item.Mapping, &item.Description, &item.Amount)
+		if err := rows.Scan(&item.Date, &item.Mapping, &item.Description, &item.Amount); err != nil {
+			return nil, err
+		}
+		entries = append(entries, item)
+	}
+	return entries, rows.Err()
+}
+
+// SumChildren sums up the transactions of this year per direct sub-category of a category,
+// each including its own sub-categories. A tag limits the sums to the transactions with that tag.
+func SumChildren(ctx context.Context, db *sql.DB, budget int, category, tag string) ([]Entry, error) {
+	sqlQuery := `WITH RECURSIVE branches(id, name, branch) AS (
+		SELECT id, name, name FROM categories WHERE parent = (SELECT id FROM categories WHERE budget = ? AND name = ?)
+		UNION ALL
+		SELECT categories.id, categories.name, branches.branch FROM categories JOIN branches ON categories.parent = branches.id)
+	SELECT branch, TOTAL(items.amount) FROM branches
+	LEFT JOIN (SELECT postings.mapping, postings.amount FROM transactions JOIN postings ON postings.transaction_id = transactions.id
+		WHERE transactions.budget = ? AND timestamp >= date('now', 'start of year')` + sqlTagFilter + `) AS items ON items.mapping = branches.name
+	GROUP BY branch ORDER BY TOTAL(items.amount)`
+	rows, err := db.QueryContext(ctx, sqlQuery, budget, category, budget, tag, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var item Entry
+		if err := rows.Scan(&item.Mapping, &item.Amount); err != nil {
+			return nil, err
+		}
 		entries = append(entries, item)
 	}
-	return entries
+	return entries, rows.Err()
 }
 
-func SumByCats(db *sql.DB, category string) []Entry {
-	sqlQuery := "SELECT strftime('%Y-%m-%d', timestamp), description, sum(amount) FROM mappings JOIN transactions USING (description) WHERE mapping = ? AND timestamp >= date('now', 'start of year') GROUP BY description"
-	rows, _ := db.Query(sqlQuery, category)
+// ReadJournal returns every transaction with its category and parts, oldest first - used by the exporters
+func ReadJournal(ctx context.Context, db *sql.DB, budget int) ([]Entry, error) {
+	sqlQuery := "SELECT transactions.id, strftime('%Y-%m-%d', timestamp) as time, COALESCE(mapping, ''), description, amount, " + sqlTagList + " FROM transactions LEFT JOIN mappings USING (description, budget) WHERE budget = ? ORDER BY timestamp, transactions.id"
+	rows, err := db.QueryContext(ctx, sqlQuery, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	splits, err := readAllSplits(ctx, db, budget)
+	if err != nil {
+		return nil, err
+	}
 	var entries []Entry
 	for rows.Next() {
 		var item Entry
-		_ = rows.Scan(&item.Date, &item.Description, &item.Amount)
+		var tags sql.NullString
+		if err := rows.Scan(&item.ID, &item.Date, &item.Mapping, &item.Description, &item.Amount, &tags); err != nil {
+			return nil, err
+		}
+		item.Tags = splitTags(tags)
+		item.Splits = splits[item.ID]
 		entries = append(entries, item)
 	}
-	return entries
+	return entries, rows.Err()
 }
 
-// UpdateCats Insert or Replace the categories
-func UpdateCats(db *sql.DB, cats []Category) {
-	var newID int64
-	rows := db.QueryRow("SELECT MAX(id) FROM mappings")
-	_ = rows.Scan(&newID)
-	tx, _ := db.Begin()
-	sqlUpdate := "INSERT OR REPLACE INTO mappings (id, mapping, description)	VALUES (?, ?, ?)"
-	stmt, _ := tx.Prepare(sqlUpdate)
+// UpdateCats inserts or updates the categories of a budget, logging the changes made by a user.
+// The mappings of other budgets are never replaced - their IDs count as new.
+func UpdateCats(ctx context.Context, db *sql.DB, budget int, user User, cats []Category) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	for i := 0; i < len(cats); i++ {
-		if FromNullInt64(cats[i].ID) == 0 {
-			newID++
-			_, err2 := stmt.Exec(newID, cats[i].Mapping, cats[i].Description)
-			if err2 != nil {
-				panic(err2)
+		var old Category
+		row := tx.QueryRowContext(ctx, "SELECT id, mapping, description FROM mappings WHERE id = ? AND budget = ?", cats[i].ID, budget)
+		switch err := row.Scan(&old.ID, &old.Mapping, &old.Description); err {
+		case sql.ErrNoRows:
+			// SQLite assigns the ID, so concurrent saves can't pick the same one
+			res, err := tx.ExecContext(ctx, "INSERT INTO mappings (budget, mapping, description) VALUES (?, ?, ?)", budget, cats[i].Mapping, cats[i].Description)
+			if err != nil {
+				return err
+			}
+			newID, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			if err := StoreAudit(ctx, tx, budget, user, "insert", "category", int(newID), nil, mappingValues(cats[i])); err != nil {
+				return err
 			}
-		} else {
-			replID := FromNullInt64(cats[i].ID)
-			_, err2 := stmt.Exec(replID, cats[i].Mapping, cats[i].Description)
-			if err2 != nil {
-				panic(err2)
+		case nil:
+			_, err := tx.ExecContext(ctx, "UPDATE mappings SET mapping = ?, description = ? WHERE id = ? AND budget = ?", cats[i].Mapping, cats[i].Description, old.ID, budget)
+			if err != nil {
+				return err
+			}
+			if action := mappingAction(old, cats[i]); action != "" {
+				if err := StoreAudit(ctx, tx, budget, user, action, "category", int(FromNullInt64(old.ID)), mappingValues(old), mappingValues(cats[i])); err != nil {
+					return err
+				}
+			}
+		default:
+			return err
+		}
+		// New categories start at the top of the tree
+		if cats[i].Mapping.Valid {
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO categories (budget, name) VALUES (?, ?)", budget, cats[i].Mapping.String); err != nil {
+				return err
 			}
 		}
+	}
+	return tx.Commit()
+}
 
+// setMapping categorizes a single description
+func setMapping(ctx context.Context, db *sql.DB, budget int, user User, description, mapping string) error {
+	var id int
+	row := db.QueryRowContext(ctx, "SELECT id FROM mappings WHERE budget = ? AND description = ?", budget, description)
+	if err := row.Scan(&id); err != nil && err != sql.ErrNoRows {
+		return err
 	}
-	tx.Commit()
+	return UpdateCats(ctx, db, budget, user, []Category{{ID: ToNullInt64(id), Description: description, Mapping: ToNullString(mapping)}})
 }
 
-// StoreItem holds logic to insert a transaction
-func StoreItem(db *sql.DB, item Transaction, transtype string) {
+// StoreItem holds logic to insert a transaction into a budget and returns its new ID.
+// Transactions without an account of the budget go to its first account. The new
+// item goes into the audit log as added by the user, in the same database transaction.
+func StoreItem(ctx context.Context, db *sql.DB, budget int, user User, item Transaction, transtype string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 	switch transtype {
 	case "fixed":
 		sqlAddItem := `
 		INSERT INTO fixed(
+			budget,
 			description,
 			amount,
 			income,
 			recurrence,
 			influence,
 			timestamp
-			) VALUES(?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			) VALUES(?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 			`
-		stmt, err := db.Prepare(sqlAddItem)
+		stmt, err := tx.PrepareContext(ctx, sqlAddItem)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		defer stmt.Close()
-		_, err2 := stmt.Exec(item.Description, item.Amount, item.Income, item.Recurrence, item.Influence)
+		res, err2 := stmt.ExecContext(ctx, budget, item.Description, item.Amount, item.Income, item.Recurrence, item.Influence)
 		if err2 != nil {
-			panic(err2)
+			return 0, err2
 		}
+		id, _ := res.LastInsertId()
+		values, err := storedValues(ctx, tx, budget, int(id), "fixed")
+		if err != nil {
+			return 0, err
+		}
+		if err := StoreAudit(ctx, tx, budget, user, "insert", "fixed", int(id), nil, values); err != nil {
+			return 0, err
+		}
+		return int(id), tx.Commit()
 	case "transaction":
 		sqlAddItem := `
 	INSERT INTO transactions(
+		budget,
 		description,
 		amount,
 		income,
-		timestamp
-	) VALUES(?, ?, ?, CURRENT_TIMESTAMP)
+		timestamp,
+		note,
+		account
+	) VALUES(?1, ?2, ?3, ?4, COALESCE(?5, CURRENT_TIMESTAMP), ?6,
+		COALESCE((SELECT id FROM accounts WHERE id = ?7 AND budget = ?1), (SELECT MIN(id) FROM accounts WHERE budget = ?1)))
 	`
-		stmt, err := db.Prepare(sqlAddItem)
+		stmt, err := tx.PrepareContext(ctx, sqlAddItem)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		defer stmt.Close()
 		if item.Income != true {
 			item.Amount = -item.Amount
 		}
-		_, err2 := stmt.Exec(item.Description, item.Amount, item.Income)
+		res, err2 := stmt.ExecContext(ctx, budget, item.Description, item.Amount, item.Income, timestampValue(item.Timestamp), item.Note, item.Account)
 		if err2 != nil {
-			panic(err2)
+			return 0, err2
 		}
+		id, _ := res.LastInsertId()
+		if err := SetTags(ctx, tx, budget, int(id), item.Tags); err != nil {
+			return 0, err
+		}
+		values, err := storedValues(ctx, tx, budget, int(id), "transactions")
+		if err != nil {
+			return 0, err
+		}
+		if err := StoreAudit(ctx, tx, budget, user, "insert", "transaction", int(id), nil, values); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return int(id), categorize(ctx, db, budget, user, item)
+	}
+	return 0, fmt.Errorf("unknown type %q", transtype)
+}
+
+// timestampValue formats a timestamp the way CURRENT_TIMESTAMP does (UTC), so
+// comparisons with date('now') keep working. A zero time gives NULL.
+func timestampValue(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
 	}
+	return t.UTC().Format("2006-01-02 15:04:05")
 }
 
-// ChangeItem holds logic to insert a transaction
-func ChangeItem(db *sql.DB, item Transaction, transtype string) {
+// ChangeItem holds logic to change a transaction or fixed item of a budget, logging
+// the old and new values. Reconciled transactions have to be unlocked first.
+func ChangeItem(ctx context.Context, db *sql.DB, budget int, user User, item Transaction, transtype string) error {
+	if !itemTypes[transtype] {
+		return fmt.Errorf("unknown type %q", transtype)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := getSingle(ctx, tx, budget, item.ID, transtype)
+	if err != nil {
+		return err
+	}
 	switch transtype {
 	case "fixed":
 		sqlAddItem := `
@@ -235,133 +803,1201 @@ func ChangeItem(db *sql.DB, item Transaction, transtype string) {
 			income = ?,
 			recurrence = ?,
 			influence = ?
-			WHERE id = ?
+			WHERE id = ? AND budget = ?
 			`
-		stmt, err := db.Prepare(sqlAddItem)
+		stmt, err := tx.PrepareContext(ctx, sqlAddItem)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		defer stmt.Close()
 		influence := calcRate(item)
-		_, err2 := stmt.Exec(item.Description, item.Amount, item.Income, item.Recurrence, influence, item.ID)
+		_, err2 := stmt.ExecContext(ctx, item.Description, item.Amount, item.Income, item.Recurrence, influence, item.ID, budget)
 		if err2 != nil {
-			panic(err2)
+			return err2
+		}
+		values, err := storedValues(ctx, tx, budget, item.ID, transtype)
+		if err != nil {
+			return err
+		}
+		if err := StoreAudit(ctx, tx, budget, user, "update", "fixed", item.ID, itemValues(ctx, tx, budget, old), values); err != nil {
+			return err
 		}
 	case "transactions":
+		if ReadLock(ctx, tx, item.ID) != "" {
+			return errLocked
+		}
 		sqlAddItem := `
 	UPDATE transactions SET
-		description = ?,
-		amount = ?,
-		income = ?
-	WHERE id = ?
+		description = ?1,
+		amount = ?2,
+		income = ?3,
+		note = ?4,
+		account = COALESCE((SELECT id FROM accounts WHERE id = ?5 AND budget = ?7), account)
+	WHERE id = ?6 AND budget = ?7
 	`
-		stmt, err := db.Prepare(sqlAddItem)
+		stmt, err := tx.PrepareContext(ctx, sqlAddItem)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		defer stmt.Close()
 		if item.Income != true {
 			item.Amount = -item.Amount
 		}
-		_, err2 := stmt.Exec(item.Description, item.Amount, item.Income, item.ID)
+		_, err2 := stmt.ExecContext(ctx, item.Description, item.Amount, item.Income, item.Note, item.Account, item.ID, budget)
 		if err2 != nil {
-			panic(err2)
+			return err2
+		}
+		// Cleared on an account it doesn't belong to anymore
+		_, err3 := tx.ExecContext(ctx, "DELETE FROM clearings WHERE transaction_id = ? AND account != (SELECT account FROM transactions WHERE id = ?)", item.ID, item.ID)
+		if err3 != nil {
+			return err3
+		}
+		if err := SetTags(ctx, tx, budget, item.ID, item.Tags); err != nil {
+			return err
+		}
+		values, err := storedValues(ctx, tx, budget, item.ID, transtype)
+		if err != nil {
+			return err
+		}
+		if err := StoreAudit(ctx, tx, budget, user, "update", "transaction", item.ID, itemValues(ctx, tx, budget, old), values); err != nil {
+			return err
 		}
 	}
+	return tx.Commit()
 }
 
-// ReadItem returns the items
-func ReadItem(db *sql.DB, transtype string) []Transaction {
-	var result []Transaction
-	switch transtype {
-	case "fixed":
-		sqlReadFix := `
-		SELECT id, description, amount, income, influence, recurrence FROM fixed
-		ORDER BY amount DESC
-		`
-
-		rows, err := db.Query(sqlReadFix)
+// SetTags replaces the tags of a transaction with tags of its budget, inside the
+// database transaction of the change
+func SetTags(ctx context.Context, tx execer, budget, id int, tags []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM transaction_tags WHERE transaction_id = ?", id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO tags (budget, name) VALUES (?, ?)", budget, tag)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		for rows.Next() {
-			item := Transaction{}
-			_ = rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Influence, &item.Recurrence)
-			result = append(result, item)
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO transaction_tags (transaction_id, tag_id) SELECT ?, id FROM tags WHERE budget = ? AND name = ?", id, budget, tag)
+		if err != nil {
+			return err
 		}
-	case "transaction":
-		sqlReadTrans := `
-		SELECT id, description, amount, income FROM transactions
-		WHERE datetime(timestamp) >= DATE('now')
-		ORDER BY datetime(timestamp) DESC
-		`
-		rows, err := db.Query(sqlReadTrans)
+	}
+	return nil
+}
+
+// SetSplits replaces the parts of a transaction - no parts remove the split.
+// New categories start at the top of the tree of its budget. The change goes
+// into the audit log as made by the user.
+func SetSplits(ctx context.Context, db *sql.DB, budget int, user User, id int, splits []Split) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := splitValues(ctx, tx, budget, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM splits WHERE transaction_id = ?", id); err != nil {
+		return err
+	}
+	for _, split := range splits {
+		_, err = tx.ExecContext(ctx, "INSERT INTO splits (transaction_id, amount, mapping) VALUES (?, ?, ?)", id, split.Amount, ToNullString(split.Mapping))
 		if err != nil {
-			panic(err)
+			return err
 		}
-		for rows.Next() {
-			item := Transaction{}
-			_ = rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income)
-			result = append(result, item)
+		if split.Mapping != "" {
+			_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO categories (budget, name) VALUES (?, ?)", budget, split.Mapping)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	return result
+	new, err := splitValues(ctx, tx, budget, id)
+	if err != nil {
+		return err
+	}
+	if action := partsAction(old.Splits, new.Splits); action != "" {
+		if err := StoreAudit(ctx, tx, budget, user, action, "split", id, old, new); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func getSingle(db *sql.DB, id int, transtype string) Transaction {
-	row := db.QueryRow("SELECT id, description, amount, income, recurrence FROM "+transtype+" WHERE id = ?", id)
-	var item Transaction
-	_ = row.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Recurrence)
-	return item
+// ReadSplits returns the parts of a transaction, nil if it isn't split
+func ReadSplits(ctx context.Context, db querier, budget, id int) ([]Split, error) {
+	splits, err := readAllSplits(ctx, db, budget, id)
+	return splits[id], err
 }
 
-func baseMagic(db *sql.DB) float64 {
-	var magicNumber float64
-	sqlRead := `SELECT SUM(influence) FROM fixed`
-	row := db.QueryRow(sqlRead)
-	_ = row.Scan(&magicNumber)
-	return magicNumber
+// readAllSplits returns the parts of the split transactions of a budget by transaction ID -
+// of all of them or only the given ones
+func readAllSplits(ctx context.Context, db querier, budget int, ids ...int) (map[int][]Split, error) {
+	sqlRead := "SELECT splits.id, transaction_id, splits.amount, COALESCE(mapping, '') FROM splits JOIN transactions ON transactions.id = splits.transaction_id WHERE budget = ?"
+	args := []interface{}{budget}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	if len(ids) > 0 {
+		sqlRead += " AND transaction_id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	}
+	rows, err := db.QueryContext(ctx, sqlRead+" ORDER BY splits.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[int][]Split)
+	for rows.Next() {
+		var split Split
+		var transaction int
+		if err := rows.Scan(&split.ID, &transaction, &split.Amount, &split.Mapping); err != nil {
+			return nil, err
+		}
+		result[transaction] = append(result[transaction], split)
+	}
+	return result, rows.Err()
 }
 
-// This returns the total of all expenses from a specified period (week, month or year)
-func totalExpenses(db *sql.DB, period string) float64 {
-	var sqlRead string
-	var totalExpenses float64
-	switch period {
-	case "week":
-		sqlRead = "SELECT SUM(amount) FROM transactions WHERE timestamp >= date('now', 'weekday 0', '-6 days');"
-	case "month":
-		sqlRead = "SELECT SUM(amount) FROM transactions WHERE timestamp >= date('now', 'start of month');"
-	case "year":
-		sqlRead = "SELECT SUM(amount) FROM transactions WHERE timestamp >= date('now', 'start of year');"
+// SetShares sets who paid a transaction of a budget and how it is shared - no shares
+// and no payer make it a transaction of the whole budget again. The change goes into
+// the audit log as made by the user.
+func SetShares(ctx context.Context, db *sql.DB, budget int, user User, id, paidBy int, shares []Share) error {
+	var payer interface{}
+	if paidBy != 0 {
+		payer = paidBy
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := shareValues(ctx, tx, budget, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE transactions SET paid_by = ? WHERE id = ?", payer, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shares WHERE transaction_id = ?", id); err != nil {
+		return err
+	}
+	for _, share := range shares {
+		_, err = tx.ExecContext(ctx, "INSERT INTO shares (transaction_id, user_id, amount) VALUES (?, ?, ?)", id, share.ID, share.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	new, err := shareValues(ctx, tx, budget, id)
+	if err != nil {
+		return err
 	}
-	row := db.QueryRow(sqlRead)
-	_ = row.Scan(&totalExpenses)
-	return totalExpenses
+	if action := partsAction(old.parts(), new.parts()); action != "" {
+		if err := StoreAudit(ctx, tx, budget, user, action, "shares", id, old, new); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func sumUp(db *sql.DB, period string, labelchan chan []string, valchan chan []float64) {
-	var sqlRead string
-	var resultVals []float64
-	var resultStr []string
-	switch period {
-	case "daily":
-		sqlRead = "SELECT strftime('%m-%d', timestamp) as valDay, SUM(amount) AS sum FROM transactions WHERE timestamp >= date('now', 'weekday 0', '-6 days') GROUP BY valDay"
-	case "type":
-		sqlRead = "SELECT mapping, SUM(amount) FROM transactions JOIN mappings ON mappings.description = transactions.description WHERE strftime('%Y', timestamp)=strftime('%Y',date('now')) GROUP BY mappings.mapping ORDER BY SUM(amount)"
+// ReadShares returns who paid a transaction and its shares, by name - nil if it isn't shared
+func ReadShares(ctx context.Context, db querier, budget, id int) (int, []Share, error) {
+	var paidBy int
+	row := db.QueryRowContext(ctx, "SELECT COALESCE(paid_by, 0) FROM transactions WHERE id = ? AND budget = ?", id, budget)
+	_ = row.Scan(&paidBy)
+	rows, err := db.QueryContext(ctx, `SELECT users.id, users.name, shares.amount FROM shares JOIN users ON users.id = shares.user_id
+		JOIN transactions ON transactions.id = shares.transaction_id WHERE transaction_id = ? AND budget = ? ORDER BY users.name`, id, budget)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var result []Share
+	for rows.Next() {
+		var share Share
+		if err := rows.Scan(&share.ID, &share.Name, &share.Amount); err != nil {
+			return 0, nil, err
+		}
+		result = append(result, share)
+	}
+	return paidBy, result, rows.Err()
+}
+
+// ReadBalances returns what the members of a budget are owed (positive) or owe (negative)
+// from the shared transactions and the settlements, by name
+func ReadBalances(ctx context.Context, db *sql.DB, budget int) ([]Balance, error) {
+	sqlRead := `
+	SELECT users.id, users.name, TOTAL(amount) FROM (
+		SELECT paid_by AS user_id, -amount AS amount FROM transactions
+		WHERE budget = ?1 AND paid_by IS NOT NULL AND id IN (SELECT transaction_id FROM shares)
+		UNION ALL
+		SELECT user_id, CASE WHEN transactions.amount < 0 THEN -shares.amount ELSE shares.amount END
+		FROM shares JOIN transactions ON transactions.id = shares.transaction_id
+		WHERE budget = ?1 AND paid_by IS NOT NULL
+		UNION ALL
+		SELECT from_user, amount FROM settlements WHERE budget = ?1
+		UNION ALL
+		SELECT to_user, -amount FROM settlements WHERE budget = ?1
+	) JOIN users ON users.id = user_id
+	GROUP BY users.id ORDER BY users.name`
+	rows, err := db.QueryContext(ctx, sqlRead, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Balance
+	for rows.Next() {
+		var item Balance
+		if err := rows.Scan(&item.ID, &item.Name, &item.Amount); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// StoreSettlement saves a payment from one member to another
+func StoreSettlement(ctx context.Context, db *sql.DB, budget int, item Payment) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO settlements (budget, from_user, to_user, amount, timestamp) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		budget, item.From.ID, item.To.ID, item.Amount)
+	return err
+}
+
+// ReadSettlements returns the payments between the members of a budget, newest first
+func ReadSettlements(ctx context.Context, db *sql.DB, budget int) ([]Payment, error) {
+	rows, err := db.QueryContext(ctx, `SELECT date(timestamp), from_user, payer.name, to_user, payee.name, amount FROM settlements
+		JOIN users AS payer ON payer.id = from_user JOIN users AS payee ON payee.id = to_user
+		WHERE budget = ? ORDER BY timestamp DESC, settlements.id DESC`, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Payment
+	for rows.Next() {
+		var item Payment
+		if err := rows.Scan(&item.Date, &item.From.ID, &item.From.Name, &item.To.ID, &item.To.Name, &item.Amount); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// StoreAttachment saves an attachment of a transaction of a budget - with the file's content
+// as data, or nil if the file is stored at the path. It goes into the audit log as added by the user.
+func StoreAttachment(ctx context.Context, db *sql.DB, budget int, user User, item Attachment, data []byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "INSERT INTO attachments (transaction_id, filename, content_type, size, path, data, created) VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		item.TransactionID, item.Filename, item.ContentType, item.Size, item.Path, data)
+	if err != nil {
+		return err
+	}
+	err = StoreAudit(ctx, tx, budget, user, "insert", "attachment", item.TransactionID, nil,
+		auditAttachment{Description: transactionDescription(ctx, tx, item.TransactionID), Attachment: item.Filename})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlAttachmentBudget limits a query of the attachments to the ones of a budget (the argument)
+const sqlAttachmentBudget = " AND transaction_id IN (SELECT id FROM transactions WHERE budget = ?)"
+
+// ReadAttachments returns the attachments of a transaction (without their content)
+func ReadAttachments(ctx context.Context, db *sql.DB, budget, transaction int) ([]Attachment, error) {
+	var result []Attachment
+	rows, err := db.QueryContext(ctx, "SELECT id, transaction_id, filename, content_type, size, path, created FROM attachments WHERE transaction_id = ?"+sqlAttachmentBudget+" ORDER BY id", transaction, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item Attachment
+		if err := rows.Scan(&item.ID, &item.TransactionID, &item.Filename, &item.ContentType, &item.Size, &item.Path, &item.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadAttachment returns a single attachment of a budget with its content, if stored in the database
+func ReadAttachment(ctx context.Context, db *sql.DB, budget, id int) (Attachment, []byte) {
+	var item Attachment
+	var data []byte
+	row := db.QueryRowContext(ctx, "SELECT id, transaction_id, filename, content_type, size, path, created, data FROM attachments WHERE id = ?"+sqlAttachmentBudget, id, budget)
+	_ = row.Scan(&item.ID, &item.TransactionID, &item.Filename, &item.ContentType, &item.Size, &item.Path, &item.Created, &data)
+	return item, data
+}
+
+// DeleteAttachment removes an attachment of a budget and returns how often its file is still
+// referenced by other attachments (of any budget). The delete goes into the audit log as made by the user.
+func DeleteAttachment(ctx context.Context, db *sql.DB, budget int, user User, id int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var path sql.NullString
+	var transaction int
+	var filename string
+	row := tx.QueryRowContext(ctx, "SELECT path, transaction_id, filename FROM attachments WHERE id = ?"+sqlAttachmentBudget, id, budget)
+	switch err := row.Scan(&path, &transaction, &filename); err {
+	case nil:
+		err = StoreAudit(ctx, tx, budget, user, "delete", "attachment", transaction,
+			auditAttachment{Description: transactionDescription(ctx, tx, transaction), Attachment: filename}, nil)
+		if err != nil {
+			return 0, err
+		}
+	case sql.ErrNoRows:
+	default:
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM attachments WHERE id = ?"+sqlAttachmentBudget, id, budget); err != nil {
+		return 0, err
+	}
+	var count int
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM attachments WHERE path = ?", path)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// readAttachmentPaths returns the files of all attachments stored outside the database
+func readAttachmentPaths(ctx context.Context, db *sql.DB) ([]string, error) {
+	var result []string
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT path FROM attachments WHERE path IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		_ = rows.Scan(&path)
+		result = append(result, path)
+	}
+	return result, rows.Err()
+}
+
+// sqlBalance selects the balance of an account: the opening balance with its
+// transactions and the transfers in and out
+const sqlBalance = `opening + (SELECT TOTAL(amount) FROM transactions WHERE account = accounts.id)
+	+ (SELECT TOTAL(amount) FROM transfers WHERE to_account = accounts.id)
+	- (SELECT TOTAL(amount) FROM transfers WHERE from_account = accounts.id)`
+
+// ReadAccounts returns all accounts of a budget with their current balance, by name
+func ReadAccounts(ctx context.Context, db *sql.DB, budget int) ([]Account, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, kind, opening, "+sqlBalance+" FROM accounts WHERE budget = ? ORDER BY name", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Account
+	for rows.Next() {
+		var item Account
+		if err := rows.Scan(&item.ID, &item.Name, &item.Kind, &item.Opening, &item.Balance); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadAccount returns a single account of a budget with its current balance - an ID of 0 if there is none
+func ReadAccount(ctx context.Context, db querier, budget, id int) Account {
+	var item Account
+	row := db.QueryRowContext(ctx, "SELECT id, name, kind, opening, "+sqlBalance+" FROM accounts WHERE id = ? AND budget = ?", id, budget)
+	_ = row.Scan(&item.ID, &item.Name, &item.Kind, &item.Opening, &item.Balance)
+	return item
+}
+
+// findAccount returns the ID of the account of a budget with a name (in any case), or 0
+func findAccount(ctx context.Context, db *sql.DB, budget int, name string) int {
+	var id int
+	row := db.QueryRowContext(ctx, "SELECT id FROM accounts WHERE budget = ? AND name = ? COLLATE NOCASE", budget, name)
+	_ = row.Scan(&id)
+	return id
+}
+
+// StoreAccount inserts a new account into a budget and returns its ID
+func StoreAccount(ctx context.Context, db *sql.DB, budget int, item Account) (int, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO accounts (budget, name, kind, opening) VALUES (?, ?, ?, ?)", budget, item.Name, item.Kind, item.Opening)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// ChangeAccount updates the name, kind and opening balance of an account of a budget
+func ChangeAccount(ctx context.Context, db *sql.DB, budget int, item Account) error {
+	_, err := db.ExecContext(ctx, "UPDATE accounts SET name = ?, kind = ?, opening = ? WHERE id = ? AND budget = ?", item.Name, item.Kind, item.Opening, item.ID, budget)
+	return err
+}
+
+// countAccountUse returns the number of transactions and transfers of an account
+func countAccountUse(ctx context.Context, db *sql.DB, id int) int {
+	var count int
+	row := db.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM transactions WHERE account = ?)
+		+ (SELECT COUNT(*) FROM transfers WHERE from_account = ? OR to_account = ?)`, id, id, id)
+	_ = row.Scan(&count)
+	return count
+}
+
+// DeleteAccount removes an account of a budget
+func DeleteAccount(ctx context.Context, db *sql.DB, budget, id int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM accounts WHERE id = ? AND budget = ?", id, budget)
+	return err
+}
+
+// StoreTransfer inserts a new transfer of a budget and returns its ID. It goes into the
+// audit log as added by the user.
+func StoreTransfer(ctx context.Context, db *sql.DB, budget int, user User, item Transfer) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "INSERT INTO transfers (from_account, to_account, amount, description, timestamp) VALUES (?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP))",
+		item.From, item.To, item.Amount, item.Description, timestampValue(item.Timestamp))
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := StoreAudit(ctx, tx, budget, user, "insert", "transfer", int(id), nil, transferValues(ctx, tx, int(id))); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// DeleteTransfer removes a transfer between accounts of a budget. The delete goes into
+// the audit log as made by the user.
+func DeleteTransfer(ctx context.Context, db *sql.DB, budget int, user User, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old := transferValues(ctx, tx, id)
+	res, err := tx.ExecContext(ctx, "DELETE FROM transfers WHERE id = ? AND from_account IN (SELECT id FROM accounts WHERE budget = ?)", id, budget)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count > 0 {
+		if err := StoreAudit(ctx, tx, budget, user, "delete", "transfer", id, old, nil); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReadRegister returns the transactions and transfers of an account of a budget, oldest first, with
+// their clearing. Transfers out of the account are negative. The balances are left to the caller.
+func ReadRegister(ctx context.Context, db *sql.DB, budget, account int) ([]RegisterLine, error) {
+	sqlRead := `SELECT lines.*, clearings.account IS NOT NULL, COALESCE(clearings.reconciliation_id, 0) FROM (
+	SELECT id AS transaction_id, 0 AS transfer_id, datetime(timestamp) AS sortkey, strftime('%Y-%m-%d', timestamp), description, amount
+		FROM transactions WHERE account = ?1 AND budget = ?2
+	UNION ALL
+	SELECT 0, transfers.id, datetime(timestamp), strftime('%Y-%m-%d', timestamp), COALESCE(NULLIF(description, ''), 'Transfer to ' || name), -amount
+		FROM transfers JOIN accounts ON accounts.id = to_account WHERE from_account = ?1 AND budget = ?2
+	UNION ALL
+	SELECT 0, transfers.id, datetime(timestamp), strftime('%Y-%m-%d', timestamp), COALESCE(NULLIF(description, ''), 'Transfer from ' || name), amount
+		FROM transfers JOIN accounts ON accounts.id = from_account WHERE to_account = ?1 AND budget = ?2
+	) AS lines LEFT JOIN clearings ON clearings.account = ?1 AND clearings.transaction_id = lines.transaction_id AND clearings.transfer_id = lines.transfer_id
+	ORDER BY sortkey, lines.transaction_id, lines.transfer_id`
+	rows, err := db.QueryContext(ctx, sqlRead, account, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []RegisterLine
+	for rows.Next() {
+		var item RegisterLine
+		var sortkey string
+		if err := rows.Scan(&item.TransactionID, &item.TransferID, &sortkey, &item.Date, &item.Description, &item.Amount, &item.Cleared, &item.Reconciliation); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadLock returns the statement date of the reconciliation a transaction belongs to,
+// or an empty string if it isn't locked
+func ReadLock(ctx context.Context, db querier, transaction int) string {
+	var date string
+	row := db.QueryRowContext(ctx, `SELECT statement_date FROM clearings JOIN reconciliations ON reconciliations.id = clearings.reconciliation_id
+		WHERE clearings.transaction_id = ?`, transaction)
+	_ = row.Scan(&date)
+	return date
+}
+
+// readTransferLock returns whether a side of a transfer of a budget belongs to a reconciliation
+func readTransferLock(ctx context.Context, db *sql.DB, budget, transfer int) bool {
+	var count int
+	row := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM clearings WHERE transfer_id = ? AND reconciliation_id IS NOT NULL
+		AND account IN (SELECT id FROM accounts WHERE budget = ?)`, transfer, budget)
+	_ = row.Scan(&count)
+	return count > 0
+}
+
+// UnlockTransaction takes a transaction of a budget out of its reconciliation - it stays cleared
+func UnlockTransaction(ctx context.Context, db *sql.DB, budget, transaction int) error {
+	_, err := db.ExecContext(ctx, "UPDATE clearings SET reconciliation_id = NULL WHERE transaction_id = ? AND account IN (SELECT id FROM accounts WHERE budget = ?)", transaction, budget)
+	return err
+}
+
+// SetCleared replaces the cleared lines of an account that aren't reconciled yet. With a
+// reconciliation given, the cleared lines are locked into it.
+func SetCleared(ctx context.Context, db *sql.DB, account int, lines []RegisterLine, reconciliation sql.NullInt64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM clearings WHERE account = ? AND reconciliation_id IS NULL", account); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		_, err := tx.ExecContext(ctx, "INSERT INTO clearings (account, transaction_id, transfer_id, reconciliation_id) VALUES (?, ?, ?, ?)",
+			account, line.TransactionID, line.TransferID, reconciliation)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// StoreReconciliation inserts a finished reconciliation and returns its ID
+func StoreReconciliation(ctx context.Context, db *sql.DB, item Reconciliation) (int, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO reconciliations (account, statement_date, closing, created) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		item.Account, item.Date, item.Closing)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// ReadLastReconciliation returns the newest reconciliation of an account - an ID of 0 if there is none
+func ReadLastReconciliation(ctx context.Context, db *sql.DB, account int) Reconciliation {
+	var item Reconciliation
+	row := db.QueryRowContext(ctx, "SELECT id, account, statement_date, closing FROM reconciliations WHERE account = ? ORDER BY statement_date DESC, id DESC LIMIT 1", account)
+	_ = row.Scan(&item.ID, &item.Account, &item.Date, &item.Closing)
+	return item
+}
+
+// ReadUsers returns all users by name - without their passwords
+func ReadUsers(ctx context.Context, db *sql.DB) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM users ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []User
+	for rows.Next() {
+		var item User
+		if err := rows.Scan(&item.ID, &item.Name); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadUser returns a user by name with the hash of the password - an ID of 0 if there is none
+func ReadUser(ctx context.Context, db *sql.DB, name string) (User, string, error) {
+	var item User
+	var password sql.NullString
+	row := db.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE name = ?", name)
+	if err := row.Scan(&item.ID, &item.Name, &password); err != nil && err != sql.ErrNoRows {
+		return User{}, "", err
+	}
+	return item, password.String, nil
+}
+
+// StoreUser inserts a new user and returns the ID
+func StoreUser(ctx context.Context, db *sql.DB, name, password string) (int, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO users (name, password, created) VALUES (?, ?, CURRENT_TIMESTAMP)", name, password)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// ChangePassword replaces the password hash of a user and ends all of the user's sessions
+func ChangePassword(ctx context.Context, db *sql.DB, id int, password string) error {
+	if _, err := db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", password, id); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", id)
+	return err
+}
+
+// DeleteUser removes a user with all sessions and memberships
+func DeleteUser(ctx context.Context, db *sql.DB, id int) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM budget_members WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+// StoreSession starts a session, by the hash of its token. Expired sessions are cleaned up on the way.
+func StoreSession(ctx context.Context, db *sql.DB, token string, user int, expires time.Time) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE expires <= datetime('now')"); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO sessions (token, user_id, created, expires) VALUES (?, ?, CURRENT_TIMESTAMP, ?)",
+		token, user, timestampValue(expires))
+	return err
+}
+
+// ReadSession returns the user of a running session, by the hash of its token - an ID of 0 if there is none
+func ReadSession(ctx context.Context, db *sql.DB, token string) User {
+	var item User
+	row := db.QueryRowContext(ctx, `SELECT users.id, users.name FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE token = ? AND expires > datetime('now')`, token)
+	_ = row.Scan(&item.ID, &item.Name)
+	return item
+}
+
+// DeleteSession ends a session, by the hash of its token
+func DeleteSession(ctx context.Context, db *sql.DB, token string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+// StoreAudit appends a change to the audit log - old and new are stored as JSON, nil as NULL
+func StoreAudit(ctx context.Context, db execer, budget int, user User, action, kind string, id int, oldValues, newValues interface{}) error {
+	values := make([]interface{}, 2)
+	for i, value := range []interface{}{oldValues, newValues} {
+		if value == nil {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[i] = string(data)
+	}
+	// Changes on the command line have no user ID
+	var userID interface{}
+	if user.ID != 0 {
+		userID = user.ID
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO audit (budget, timestamp, user_id, user_name, action, kind, item_id, old, new)
+		VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?)`,
+		budget, userID, user.Name, action, kind, id, values[0], values[1])
+	return err
+}
+
+// ReadAudit returns the changes in a budget, newest first - of a single item if a kind
+// and ID are given (with the changes of their parts for transactions), older than the change before if that isn't 0, at most limit (-1 for all)
+func ReadAudit(ctx context.Context, db *sql.DB, budget int, kind string, id, before, limit int) ([]AuditEntry, error) {
+	sqlRead := `SELECT id, datetime(timestamp, 'localtime'), user_name, action, kind, item_id, COALESCE(old, ''), COALESCE(new, '')
+		FROM audit WHERE budget = ?`
+	args := []interface{}{budget}
+	if kind != "" {
+		kinds := []string{kind}
+		if kind == "transaction" {
+			kinds = append(kinds, auditParts...)
+		}
+		sqlRead += " AND kind IN (?" + strings.Repeat(", ?", len(kinds)-1) + ") AND item_id = ?"
+		for _, kind := range kinds {
+			args = append(args, kind)
+		}
+		args = append(args, id)
+	}
+	if before != 0 {
+		sqlRead += " AND id < ?"
+		args = append(args, before)
+	}
+	rows, err := db.QueryContext(ctx, sqlRead+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AuditEntry
+	for rows.Next() {
+		var item AuditEntry
+		if err := rows.Scan(&item.ID, &item.Time, &item.User, &item.Action, &item.Kind, &item.ItemID, &item.Old, &item.New); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadBudgets returns the budgets a user is a member of with the user's role, by name
+func ReadBudgets(ctx context.Context, db *sql.DB, user int) ([]Budget, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, name, role FROM budgets JOIN budget_members ON budget_members.budget_id = budgets.id
+		WHERE user_id = ? ORDER BY name, id`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Budget
+	for rows.Next() {
+		var item Budget
+		if err := rows.Scan(&item.ID, &item.Name, &item.Role); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadBudget returns a budget with the role of a user - an ID of 0 if the user isn't a member
+func ReadBudget(ctx context.Context, db *sql.DB, user, id int) Budget {
+	var item Budget
+	row := db.QueryRowContext(ctx, `SELECT id, name, role FROM budgets JOIN budget_members ON budget_members.budget_id = budgets.id
+		WHERE user_id = ? AND id = ?`, user, id)
+	_ = row.Scan(&item.ID, &item.Name, &item.Role)
+	return item
+}
+
+// readAllBudgets returns all budgets, oldest first - without a role
+func readAllBudgets(ctx context.Context, db *sql.DB) ([]Budget, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM budgets ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Budget
+	for rows.Next() {
+		var item Budget
+		if err := rows.Scan(&item.ID, &item.Name); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// StoreBudget inserts a new budget with its owner and a first account, and returns its ID
+func StoreBudget(ctx context.Context, db *sql.DB, name string, owner int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "INSERT INTO budgets (name, created) VALUES (?, CURRENT_TIMESTAMP)", name)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO budget_members (budget_id, user_id, role) VALUES (?, ?, 'owner')", id, owner); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO accounts (budget, name, kind) VALUES (?, 'Cash', 'cash')", id); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// ChangeBudget renames a budget
+func ChangeBudget(ctx context.Context, db *sql.DB, id int, name string) error {
+	_, err := db.ExecContext(ctx, "UPDATE budgets SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+// ReadMembers returns the members of a budget with their roles, by name
+func ReadMembers(ctx context.Context, db *sql.DB, budget int) ([]Member, error) {
+	rows, err := db.QueryContext(ctx, `SELECT users.id, users.name, role FROM budget_members JOIN users ON users.id = budget_members.user_id
+		WHERE budget_id = ? ORDER BY users.name`, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Member
+	for rows.Next() {
+		var item Member
+		if err := rows.Scan(&item.ID, &item.Name, &item.Role); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// SetMember adds a user to a budget or changes the user's role
+func SetMember(ctx context.Context, db *sql.DB, budget, user int, role string) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO budget_members (budget_id, user_id, role) VALUES (?, ?, ?)", budget, user, role)
+	return err
+}
+
+// DeleteMember removes a user from a budget
+func DeleteMember(ctx context.Context, db *sql.DB, budget, user int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM budget_members WHERE budget_id = ? AND user_id = ?", budget, user)
+	return err
+}
+
+// claimBudgets makes a user the owner of all budgets without members
+func claimBudgets(ctx context.Context, db *sql.DB, user int) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO budget_members (budget_id, user_id, role)
+		SELECT id, ?, 'owner' FROM budgets WHERE id NOT IN (SELECT budget_id FROM budget_members)`, user)
+	return err
+}
+
+// ReadTags returns the tags of a transaction of a budget
+func ReadTags(ctx context.Context, db querier, budget, id int) []string {
+	var tags sql.NullString
+	row := db.QueryRowContext(ctx, "SELECT "+sqlTagList+" FROM transactions WHERE id = ? AND budget = ?", id, budget)
+	_ = row.Scan(&tags)
+	return splitTags(tags)
+}
+
+// ReadAllTags returns the names of all tags in use in a budget
+func ReadAllTags(ctx context.Context, db *sql.DB, budget int) ([]string, error) {
+	var result []string
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT name FROM tags JOIN transaction_tags ON tags.id = transaction_tags.tag_id WHERE budget = ? ORDER BY name", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		result = append(result, name)
+	}
+	return result, rows.Err()
+}
+
+// SumTags sums up the transactions per tag between two dates (both included, "YYYY-MM-DD").
+// An empty date leaves the range open on that side.
+func SumTags(ctx context.Context, db *sql.DB, budget int, from, to string) ([]TagTotal, error) {
+	var result []TagTotal
+	sqlRead := `SELECT name, COUNT(*), TOTAL(CASE WHEN amount < 0 THEN amount END), TOTAL(CASE WHEN amount > 0 THEN amount END)
+	FROM tags JOIN transaction_tags ON tags.id = transaction_tags.tag_id
+	JOIN transactions ON transactions.id = transaction_tags.transaction_id
+	WHERE tags.budget = ?3 AND (?1 = '' OR date(timestamp) >= ?1) AND (?2 = '' OR date(timestamp) <= ?2)
+	GROUP BY name ORDER BY name`
+	rows, err := db.QueryContext(ctx, sqlRead, from, to, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item TagTotal
+		if err := rows.Scan(&item.Name, &item.Count, &item.Expenses, &item.Income); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadItem returns the items of a budget
+func ReadItem(ctx context.Context, db *sql.DB, budget int, transtype string) ([]Transaction, error) {
+	var result []Transaction
+	switch transtype {
+	case "fixed":
+		sqlReadFix := `
+		SELECT id, description, amount, income, influence, recurrence FROM fixed
+		WHERE budget = ?
+		ORDER BY amount DESC
+		`
+
+		rows, err := db.QueryContext(ctx, sqlReadFix, budget)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			item := Transaction{}
+			if err := rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Influence, &item.Recurrence); err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	case "transaction":
+		sqlReadTrans := `
+		SELECT id, description, amount, income, ` + sqlTagList + ` FROM transactions
+		WHERE budget = ? AND datetime(timestamp) >= DATE('now')
+		ORDER BY datetime(timestamp) DESC
+		`
+		rows, err := db.QueryContext(ctx, sqlReadTrans, budget)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			item := Transaction{}
+			var tags sql.NullString
+			if err := rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &tags); err != nil {
+				return nil, err
+			}
+			item.Tags = splitTags(tags)
+			result = append(result, item)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// SearchTransactions returns a page of the transactions of a budget selected by the filter,
+// with their category, tags and parts
+func SearchTransactions(ctx context.Context, db *sql.DB, budget int, f TransactionFilter) ([]Entry, error) {
+	where, args := f.where(budget)
+	sqlRead := "SELECT transactions.id, strftime('%Y-%m-%d', timestamp), COALESCE(mapping, ''), description, amount, " + sqlTagList +
+		" FROM transactions LEFT JOIN mappings USING (description, budget) WHERE " + where + " ORDER BY " + f.orderBy() + " LIMIT ? OFFSET ?"
+	rows, err := db.QueryContext(ctx, sqlRead, append(args, f.PerPage, (f.Page-1)*f.PerPage)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Entry
+	var ids []int
+	for rows.Next() {
+		var item Entry
+		var tags sql.NullString
+		if err := rows.Scan(&item.ID, &item.Date, &item.Mapping, &item.Description, &item.Amount, &tags); err != nil {
+			return nil, err
+		}
+		item.Tags = splitTags(tags)
+		result = append(result, item)
+		ids = append(ids, item.ID)
+	}
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return result, err
+	}
+	splits, err := readAllSplits(ctx, db, budget, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].Splits = splits[result[i].ID]
+	}
+	return result, nil
+}
+
+// CountTransactions returns the number and the sum of all transactions of a budget selected by the filter
+func CountTransactions(ctx context.Context, db *sql.DB, budget int, f TransactionFilter) (int, float64) {
+	where, args := f.where(budget)
+	var count int
+	var sum float64
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*), TOTAL(amount) FROM transactions LEFT JOIN mappings USING (description, budget) WHERE "+where, args...)
+	_ = row.Scan(&count, &sum)
+	return count, sum
+}
+
+// readAllTransactions returns every transaction of a budget, oldest first
+func readAllTransactions(ctx context.Context, db *sql.DB, budget int) ([]Transaction, error) {
+	var result []Transaction
+	rows, err := db.QueryContext(ctx, "SELECT id, description, amount, income, timestamp FROM transactions WHERE budget = ? ORDER BY timestamp, id", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item := Transaction{}
+		if err := rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Timestamp); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadUncategorised returns all transactions of a budget without a category, newest first.
+// Split transactions are categorized by their parts, so they never show up here.
+func ReadUncategorised(ctx context.Context, db *sql.DB, budget int) ([]Transaction, error) {
+	var result []Transaction
+	sqlRead := `SELECT transactions.id, description, amount, income, timestamp FROM transactions
+	LEFT JOIN mappings USING (description, budget) WHERE budget = ? AND COALESCE(mapping, '') = ''
+	AND transactions.id NOT IN (SELECT transaction_id FROM splits)
+	ORDER BY timestamp DESC, transactions.id DESC`
+	rows, err := db.QueryContext(ctx, sqlRead, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item := Transaction{}
+		if err := rows.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Timestamp); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// readDescriptions returns the distinct descriptions of the given transactions of a budget
+func readDescriptions(ctx context.Context, db *sql.DB, budget int, ids []int) ([]string, error) {
+	var result []string
+	if len(ids) == 0 {
+		return result, nil
+	}
+	args := []interface{}{budget}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	sqlRead := "SELECT DISTINCT description FROM transactions WHERE budget = ? AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	rows, err := db.QueryContext(ctx, sqlRead, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var description string
+		if err := rows.Scan(&description); err != nil {
+			return nil, err
+		}
+		result = append(result, description)
+	}
+	return result, rows.Err()
+}
+
+// ReadRules returns all categorisation rules of a budget, highest priority first
+func ReadRules(ctx context.Context, db *sql.DB, budget int) ([]Rule, error) {
+	var result []Rule
+	rows, err := db.QueryContext(ctx, "SELECT id, priority, kind, pattern, min, max, mapping FROM rules WHERE budget = ? ORDER BY priority DESC, id", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule Rule
+		if err := rows.Scan(&rule.ID, &rule.Priority, &rule.Kind, &rule.Pattern, &rule.Min, &rule.Max, &rule.Mapping); err != nil {
+			return nil, err
+		}
+		rule.compile()
+		result = append(result, rule)
+	}
+	return result, rows.Err()
+}
+
+// StoreRule inserts a new categorisation rule into a budget
+func StoreRule(ctx context.Context, db *sql.DB, budget int, rule Rule) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO rules (budget, priority, kind, pattern, min, max, mapping) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		budget, rule.Priority, rule.Kind, rule.Pattern, rule.Min, rule.Max, rule.Mapping)
+	return err
+}
+
+// DeleteRule removes a categorisation rule of a budget
+func DeleteRule(ctx context.Context, db *sql.DB, budget, id int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM rules WHERE id = ? AND budget = ?", id, budget)
+	return err
+}
+
+// errNotFound is returned for a transaction or fixed item that isn't in the budget
+var errNotFound = errors.New("unknown transaction")
+
+// getSingle returns a transaction or fixed item of a budget - errNotFound if there is none
+func getSingle(ctx context.Context, db querier, budget, id int, transtype string) (Transaction, error) {
+	// The type names the table, so only the known ones go into the query
+	if !itemTypes[transtype] {
+		return Transaction{}, errNotFound
+	}
+	row := db.QueryRowContext(ctx, "SELECT id, description, amount, income, COALESCE(recurrence, '') FROM "+transtype+" WHERE id = ? AND budget = ?", id, budget)
+	var item Transaction
+	err := row.Scan(&item.ID, &item.Description, &item.Amount, &item.Income, &item.Recurrence)
+	if err == sql.ErrNoRows {
+		return Transaction{}, errNotFound
+	}
+	if err != nil || transtype != "transactions" {
+		return item, err
+	}
+	row = db.QueryRowContext(ctx, "SELECT COALESCE(note, ''), COALESCE(account, 0) FROM transactions WHERE id = ? AND budget = ?", id, budget)
+	if err := row.Scan(&item.Note, &item.Account); err != nil {
+		return Transaction{}, err
+	}
+	item.Tags = ReadTags(ctx, db, budget, item.ID)
+	if item.Splits, err = ReadSplits(ctx, db, budget, item.ID); err != nil {
+		return Transaction{}, err
+	}
+	item.PaidBy, item.Shares, err = ReadShares(ctx, db, budget, item.ID)
+	return item, err
+}
+
+// baseMagic returns the daily rate of a budget from its fixed items
+func baseMagic(ctx context.Context, db *sql.DB, budget int) (float64, error) {
+	var magicNumber float64
+	sqlRead := `SELECT TOTAL(influence) FROM fixed WHERE budget = ?`
+	err := db.QueryRowContext(ctx, sqlRead, budget).Scan(&magicNumber)
+	return magicNumber, err
+}
+
+// This returns the total of all expenses from a specified period (week, month or year)
+func totalExpenses(ctx context.Context, db *sql.DB, budget int, period string) (float64, error) {
+	var sqlRead string
+	var totalExpenses float64
+	switch period {
+	case "week":
+		sqlRead = "SELECT TOTAL(amount) FROM transactions WHERE budget = ? AND timestamp >= date('now', 'weekday 0', '-6 days');"
+	case "month":
+		sqlRead = "SELECT TOTAL(amount) FROM transactions WHERE budget = ? AND timestamp >= date('now', 'start of month');"
+	case "year":
+		sqlRead = "SELECT TOTAL(amount) FROM transactions WHERE budget = ? AND timestamp >= date('now', 'start of year');"
+	}
+	err := db.QueryRowContext(ctx, sqlRead, budget).Scan(&totalExpenses)
+	return totalExpenses, err
+}
+
+// sumUp sums the transactions up by day (this week), by top-level category ("type") or by month,
+// like 2006-01. Categories and months only count the transactions from the day from up to before to.
+// Returns the labels and the sums.
+func sumUp(ctx context.Context, db *sql.DB, budget int, period, tag, from, to string) ([]string, []float64, error) {
+	var sqlRead string
+	var resultVals []float64
+	var resultStr []string
+	args := []interface{}{budget}
+	switch period {
+	case "daily":
+		sqlRead = "SELECT strftime('%m-%d', timestamp) as valDay, SUM(amount) AS sum FROM transactions WHERE budget = ? AND timestamp >= date('now', 'weekday 0', '-6 days')" + sqlTagFilter + " GROUP BY valDay"
+	case "type":
+		// Rolled up to the top-level categories
+		sqlRead = sqlRoots + `SELECT COALESCE(root, ?) AS rootname, SUM(postings.amount) FROM transactions JOIN postings ON postings.transaction_id = transactions.id
+		LEFT JOIN roots ON roots.name = postings.mapping
+		WHERE transactions.budget = ? AND date(timestamp) >= ? AND date(timestamp) < ?` + sqlTagFilter + ` GROUP BY rootname ORDER BY SUM(postings.amount)`
+		args = append(args, uncategorised, budget, from, to)
 	case "monthly":
-		sqlRead = "SELECT strftime('%m', timestamp) as valMonth, SUM(amount) AS sum FROM transactions WHERE timestamp >= date('now', 'start of year') GROUP BY valMonth"
+		sqlRead = "SELECT strftime('%Y-%m', timestamp) as valMonth, SUM(amount) AS sum FROM transactions WHERE budget = ? AND date(timestamp) >= ? AND date(timestamp) < ?" + sqlTagFilter + " GROUP BY valMonth"
+		args = append(args, from, to)
 	case "yearly":
-		sqlRead = "SELECT strftime('%d', timestamp) as valDay, SUM(amount) AS sum FROM transactions WHERE timestamp >= date('now', 'start of year') GROUP BY valDay"
+		sqlRead = "SELECT strftime('%d', timestamp) as valDay, SUM(amount) AS sum FROM transactions WHERE budget = ? AND timestamp >= date('now', 'start of year')" + sqlTagFilter + " GROUP BY valDay"
 	}
+	args = append(args, tag, tag)
 
-	rows, _ := db.Query(sqlRead)
+	rows, err := db.QueryContext(ctx, sqlRead, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
 	// For checking if there is an empty day (no transactions) - then get MN
 	var dayholder int
 	for rows.Next() {
 		var day string
 		var item float64
-		_ = rows.Scan(&day, &item)
+		if err := rows.Scan(&day, &item); err != nil {
+			return nil, nil, err
+		}
+		// Months are keyed with their year - the missing ones are filled in by the caller
+		if period == "monthly" {
+			resultVals = append(resultVals, item)
+			resultStr = append(resultStr, day)
+			continue
+		}
 		if dayholder == 0 {
 			dayholder, _ = strconv.Atoi(day)
 		}
@@ -376,30 +2012,225 @@ func sumUp(db *sql.DB, period string, labelchan chan []string, valchan chan []fl
 		resultStr = append(resultStr, day)
 		dayholder++
 	}
-	labelchan <- resultStr
-	valchan <- resultVals
+	return resultStr, resultVals, rows.Err()
 }
 
-func getCategories(db *sql.DB) []Category {
+// ReadYears returns the years with transactions in a budget, newest first
+func ReadYears(ctx context.Context, db *sql.DB, budget int) ([]string, error) {
+	var result []string
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT strftime('%Y', timestamp) AS year FROM transactions WHERE budget = ? AND year IS NOT NULL ORDER BY year DESC", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var year string
+		if err := rows.Scan(&year); err != nil {
+			return nil, err
+		}
+		result = append(result, year)
+	}
+	return result, rows.Err()
+}
+
+func getCategories(ctx context.Context, db *sql.DB, budget int) ([]Category, error) {
 	var result []Category
-	sqlRead := "SELECT mappings.id, mapping, description FROM transactions LEFT JOIN mappings USING (description) GROUP BY description ORDER BY mapping"
-	rows, _ := db.Query(sqlRead)
+	sqlRead := "SELECT mappings.id, mapping, description FROM transactions LEFT JOIN mappings USING (description, budget) WHERE budget = ? GROUP BY description ORDER BY mapping"
+	rows, err := db.QueryContext(ctx, sqlRead, budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var item Category
-		_ = rows.Scan(&item.ID, &item.Mapping, &item.Description)
+		if err := rows.Scan(&item.ID, &item.Mapping, &item.Description); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// ReadCategoryTree returns all categories of a budget with their parents, by name
+func ReadCategoryTree(ctx context.Context, db *sql.DB, budget int) ([]CategoryNode, error) {
+	var result []CategoryNode
+	rows, err := db.QueryContext(ctx, "SELECT id, name, parent FROM categories WHERE budget = ? ORDER BY name", budget)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item CategoryNode
+		if err := rows.Scan(&item.ID, &item.Name, &item.Parent); err != nil {
+			return nil, err
+		}
 		result = append(result, item)
 	}
-	return result
+	return result, rows.Err()
+}
+
+// MoveCategory moves a category of a budget (and so its whole subtree) below another one.
+// An invalid parent moves it to the top.
+func MoveCategory(ctx context.Context, db *sql.DB, budget, id int, parent sql.NullInt64) error {
+	_, err := db.ExecContext(ctx, "UPDATE categories SET parent = ? WHERE id = ? AND budget = ?", parent, id, budget)
+	return err
+}
+
+// CategoryUsage counts what a change to a category affects
+type CategoryUsage struct {
+	Descriptions int `json:"descriptions"`
+	Transactions int `json:"transactions"`
+	Children     int `json:"children"`
+	Rules        int `json:"rules"`
+}
+
+// ReadCategoryUsage counts the descriptions, transactions, direct sub-categories
+// and rules of a category of a budget
+func ReadCategoryUsage(ctx context.Context, db *sql.DB, budget int, name string) CategoryUsage {
+	var usage CategoryUsage
+	sqlRead := `SELECT
+	(SELECT COUNT(*) FROM mappings WHERE budget = ?2 AND mapping = ?1),
+	(SELECT COUNT(*) FROM postings JOIN transactions ON transactions.id = postings.transaction_id WHERE budget = ?2 AND mapping = ?1),
+	(SELECT COUNT(*) FROM categories WHERE parent = (SELECT id FROM categories WHERE budget = ?2 AND name = ?1)),
+	(SELECT COUNT(*) FROM rules WHERE budget = ?2 AND mapping = ?1)`
+	row := db.QueryRowContext(ctx, sqlRead, name, budget)
+	_ = row.Scan(&usage.Descriptions, &usage.Transactions, &usage.Children, &usage.Rules)
+	return usage
+}
+
+// sqlSplitBudget limits an update of the split parts to the ones of a budget (the third argument)
+const sqlSplitBudget = " AND transaction_id IN (SELECT id FROM transactions WHERE budget = ?3)"
+
+// RenameCategory renames a category of a budget everywhere - descriptions, split parts, rules and the tree.
+// The changes go into the audit log as made by the user, like those of MergeCategory and DeleteCategory.
+func RenameCategory(ctx context.Context, db *sql.DB, budget int, user User, name, newName string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	use, err := readCategoryUse(ctx, tx, budget, name)
+	if err != nil {
+		return err
+	}
+	for _, sqlUpdate := range []string{
+		"UPDATE mappings SET mapping = ?1 WHERE mapping = ?2 AND budget = ?3",
+		"UPDATE splits SET mapping = ?1 WHERE mapping = ?2" + sqlSplitBudget,
+		"UPDATE rules SET mapping = ?1 WHERE mapping = ?2 AND budget = ?3",
+		"UPDATE categories SET name = ?1 WHERE name = ?2 AND budget = ?3",
+	} {
+		if _, err := tx.ExecContext(ctx, sqlUpdate, newName, name, budget); err != nil {
+			return err
+		}
+	}
+	if err := use.audit(ctx, tx, budget, user, "rename", newName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeCategory moves everything of a category of a budget into another one and removes it.
+// The sub-categories move below the remaining category.
+func MergeCategory(ctx context.Context, db *sql.DB, budget int, user User, name, into string, intoParent sql.NullInt64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	use, err := readCategoryUse(ctx, tx, budget, name)
+	if err != nil {
+		return err
+	}
+	for _, sqlUpdate := range []string{
+		"UPDATE mappings SET mapping = ?1 WHERE mapping = ?2 AND budget = ?3",
+		"UPDATE splits SET mapping = ?1 WHERE mapping = ?2" + sqlSplitBudget,
+		"UPDATE rules SET mapping = ?1 WHERE mapping = ?2 AND budget = ?3",
+	} {
+		if _, err := tx.ExecContext(ctx, sqlUpdate, into, name, budget); err != nil {
+			return err
+		}
+	}
+	// If the remaining category lies below the merged one, it has to move up first
+	_, err = tx.ExecContext(ctx, "UPDATE categories SET parent = ? WHERE name = ? AND budget = ?", intoParent, into, budget)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE categories SET parent = (SELECT id FROM categories WHERE name = ?1 AND budget = ?3)
+		WHERE parent = (SELECT id FROM categories WHERE name = ?2 AND budget = ?3)`, into, name, budget)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM categories WHERE name = ? AND budget = ?", name, budget)
+	if err != nil {
+		return err
+	}
+	if err := use.audit(ctx, tx, budget, user, "merge", into); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteCategory removes a category of a budget. Its descriptions and split parts become uncategorised,
+// its rules are deleted and its sub-categories move up to its parent.
+func DeleteCategory(ctx context.Context, db *sql.DB, budget int, user User, name string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	use, err := readCategoryUse(ctx, tx, budget, name)
+	if err != nil {
+		return err
+	}
+	for _, sqlUpdate := range []string{
+		"DELETE FROM mappings WHERE mapping = ?1 AND budget = ?2",
+		"UPDATE splits SET mapping = NULL WHERE mapping = ?1 AND transaction_id IN (SELECT id FROM transactions WHERE budget = ?2)",
+		"DELETE FROM rules WHERE mapping = ?1 AND budget = ?2",
+		`UPDATE categories SET parent = (SELECT parent FROM categories WHERE name = ?1 AND budget = ?2)
+			WHERE parent = (SELECT id FROM categories WHERE name = ?1 AND budget = ?2)`,
+		"DELETE FROM categories WHERE name = ?1 AND budget = ?2",
+	} {
+		if _, err := tx.ExecContext(ctx, sqlUpdate, name, budget); err != nil {
+			return err
+		}
+	}
+	if err := use.audit(ctx, tx, budget, user, "delete", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func currentMagic(ctx context.Context, db *sql.DB, budget int) (float64, error) {
+	var magicNumber float64
+	sqlRead := `SELECT
+	(SELECT TOTAL(influence) FROM fixed WHERE budget = ?1) +
+	(SELECT TOTAL(amount) FROM transactions
+	WHERE budget = ?1 AND datetime(timestamp) >= DATE('now'))
+	AS magicnumber`
+	err := db.QueryRowContext(ctx, sqlRead, budget).Scan(&magicNumber)
+	return magicNumber, err
 }
 
-func currentMagic(db *sql.DB) float64 {
+// personalMagic is the current magic number of a member: shared transactions only count
+// with the member's share and the ones paid by another member for themselves not at all.
+// What belongs to the whole budget - the fixed items and the transactions nobody paid for
+// themselves - is divided equally among the members, so the members' totals add up to the
+// budget's total.
+func personalMagic(ctx context.Context, db *sql.DB, budget, user int) (float64, error) {
 	var magicNumber float64
 	sqlRead := `SELECT
-	(SELECT TOTAL(influence) FROM fixed) +
+	((SELECT TOTAL(influence) FROM fixed WHERE budget = ?1) +
 	(SELECT TOTAL(amount) FROM transactions
-	WHERE datetime(timestamp) >= DATE('now'))
+	WHERE budget = ?1 AND paid_by IS NULL AND datetime(timestamp) >= DATE('now'))) /
+	MAX((SELECT COUNT(*) FROM budget_members WHERE budget_id = ?1), 1) +
+	(SELECT TOTAL(CASE
+		WHEN id IN (SELECT transaction_id FROM shares) THEN
+			(SELECT TOTAL(shares.amount) FROM shares WHERE transaction_id = transactions.id AND user_id = ?2) *
+			CASE WHEN amount < 0 THEN -1 ELSE 1 END
+		WHEN paid_by = ?2 THEN amount
+		ELSE 0 END) FROM transactions
+	WHERE budget = ?1 AND datetime(timestamp) >= DATE('now'))
 	AS magicnumber`
-	rows := db.QueryRow(sqlRead)
-	_ = rows.Scan(&magicNumber)
-	return magicNumber
+	err := db.QueryRowContext(ctx, sqlRead, budget, user).Scan(&magicNumber)
+	return magicNumber, err
 }
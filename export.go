@@ -0,0 +1,242 @@
+/*
+This file holds the exporters for plain-text accounting tools
+like ledger, hledger and beancount
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The currency used throughout the templates
+const currency = "CHF"
+
+// Default account for the counter-posting of every exported transaction
+const defaultAssetAccount = "Assets:Cash"
+
+// exportFormats maps the supported formats to the file extension of the download
+var exportFormats = map[string]string{
+	"ledger":    "ledger",
+	"hledger":   "journal",
+	"beancount": "beancount",
+}
+
+// accountName builds a valid account name out of a root (like "Expenses") and
+// a free-text name, e.g. "eating out" becomes "Expenses:EatingOut".
+// Colons in the name are kept, so "Food:Groceries" stays a sub-account.
+func accountName(root, name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, ":") {
+		var clean []rune
+		upper := true
+		for _, r := range part {
+			switch {
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				if upper {
+					r = unicode.ToUpper(r)
+				}
+				clean = append(clean, r)
+				upper = false
+			case r == '-':
+				clean = append(clean, r)
+			default:
+				upper = true
+			}
+		}
+		if len(clean) > 0 && !unicode.IsDigit(clean[0]) && !unicode.IsUpper(clean[0]) {
+			clean = append([]rune{'X'}, clean...)
+		}
+		if len(clean) > 0 {
+			parts = append(parts, string(clean))
+		}
+	}
+	if len(parts) == 0 {
+		parts = []string{uncategorised}
+	}
+	if root == "" {
+		return strings.Join(parts, ":")
+	}
+	return root + ":" + strings.Join(parts, ":")
+}
+
+// entryAccount returns the category account of a single transaction.
+// Positive amounts are income, everything else is an expense.
+func entryAccount(item Entry) string {
+	if item.Amount > 0 {
+		return accountName("Income", item.Mapping)
+	}
+	return accountName("Expenses", item.Mapping)
+}
+
+// entryPostings returns the category postings of a single transaction - one per part
+// of a split transaction. Mapping holds the account.
+func entryPostings(item Entry) []Entry {
+	if len(item.Splits) == 0 {
+		return []Entry{{Mapping: entryAccount(item), Amount: item.Amount}}
+	}
+	var postings []Entry
+	for _, split := range item.Splits {
+		part := Entry{Mapping: split.Mapping, Amount: split.Amount}
+		if item.Amount < 0 {
+			part.Amount = -part.Amount
+		}
+		part.Mapping = entryAccount(part)
+		postings = append(postings, part)
+	}
+	return postings
+}
+
+// fixedAccount returns the account of a fixed income/expense
+func fixedAccount(item Transaction) string {
+	if item.Income {
+		return accountName("Income:Fixed", item.Description)
+	}
+	return accountName("Expenses:Fixed", item.Description)
+}
+
+// fixedPeriod translates the recurrence of a fixed item into a period expression
+// (ledger and hledger) and the amount per period.
+func fixedPeriod(item Transaction) (string, float64) {
+	switch item.Recurrence {
+	case "quarterly":
+		return "quarterly", item.Amount
+	case "twice a year":
+		return "every 6 months", item.Amount
+	case "yearly":
+		return "yearly", item.Amount
+	}
+	return "monthly", item.Amount
+}
+
+// ledgerTags formats the tags of a transaction as a ledger or hledger comment
+func ledgerTags(format string, tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	if format == "hledger" {
+		return "  ; " + strings.Join(tags, ":, ") + ":"
+	}
+	return "  ; :" + strings.Join(tags, ":") + ":"
+}
+
+// beancountRoots are the root accounts beancount allows
+var beancountRoots = []string{"Assets", "Liabilities", "Equity", "Income", "Expenses"}
+
+// beancountAsset puts an asset account under Assets, unless it is below a root beancount
+// knows - "Cash" becomes "Assets:Cash", "Liabilities:Visa" stays.
+func beancountAsset(account string) string {
+	parts := strings.SplitN(account, ":", 2)
+	for _, valid := range beancountRoots {
+		if len(parts) == 2 && parts[0] == valid {
+			return account
+		}
+	}
+	return "Assets:" + account
+}
+
+// beancountString quotes a string for beancount - backslashes and quotes are escaped
+func beancountString(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// beancountTags formats the tags of a transaction as beancount tags
+func beancountTags(tags []string) string {
+	var result string
+	for _, tag := range tags {
+		result += " #" + tag
+	}
+	return result
+}
+
+// writeJournal writes all transactions and fixed items in the given format.
+// The asset account holds the counter-posting of every transaction.
+func writeJournal(w io.Writer, format, asset string, entries []Entry, fixed []Transaction) {
+	asset = accountName("", asset)
+	switch format {
+	case "ledger", "hledger":
+		writeLedger(w, format, asset, entries, fixed)
+	case "beancount":
+		writeBeancount(w, asset, entries, fixed)
+	}
+}
+
+// writeLedger writes the ledger and hledger format - they only differ
+// in how the periodic transactions are described.
+func writeLedger(w io.Writer, format, asset string, entries []Entry, fixed []Transaction) {
+	fmt.Fprintf(w, "; Exported from GoFinance on %s\n\n", time.Now().Format("2006-01-02"))
+	for _, item := range fixed {
+		period, amount := fixedPeriod(item)
+		if !item.Income {
+			amount = -amount
+		}
+		if format == "hledger" {
+			fmt.Fprintf(w, "~ %s  %s\n", period, item.Description)
+		} else {
+			fmt.Fprintf(w, "~ %s\n    ; %s\n", period, item.Description)
+		}
+		fmt.Fprintf(w, "    %-40s %12.2f %s\n", fixedAccount(item), -amount, currency)
+		fmt.Fprintf(w, "    %-40s %12.2f %s\n\n", asset, amount, currency)
+	}
+	for _, item := range entries {
+		fmt.Fprintf(w, "%s %s%s\n", item.Date, item.Description, ledgerTags(format, item.Tags))
+		for _, posting := range entryPostings(item) {
+			fmt.Fprintf(w, "    %-40s %12.2f %s\n", posting.Mapping, -posting.Amount, currency)
+		}
+		fmt.Fprintf(w, "    %-40s %12.2f %s\n\n", asset, item.Amount, currency)
+	}
+}
+
+// writeBeancount writes the beancount format. Beancount has no periodic transactions,
+// so the fixed items are written as budgets (as understood by fava).
+func writeBeancount(w io.Writer, asset string, entries []Entry, fixed []Transaction) {
+	asset = beancountAsset(asset)
+	opened := time.Now().Format("2006-01-02")
+	if len(entries) > 0 && entries[0].Date < opened {
+		opened = entries[0].Date
+	}
+	fmt.Fprintf(w, "; Exported from GoFinance on %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(w, "option \"operating_currency\" \"%s\"\n\n", currency)
+	// Every account has to be opened before it is used
+	accounts := []string{asset}
+	seen := map[string]bool{asset: true}
+	for _, item := range fixed {
+		if account := fixedAccount(item); !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	for _, item := range entries {
+		for _, posting := range entryPostings(item) {
+			if !seen[posting.Mapping] {
+				seen[posting.Mapping] = true
+				accounts = append(accounts, posting.Mapping)
+			}
+		}
+	}
+	for _, account := range accounts {
+		fmt.Fprintf(w, "%s open %s\n", opened, account)
+	}
+	fmt.Fprintln(w)
+	for _, item := range fixed {
+		period, amount := fixedPeriod(item)
+		// fava doesn't know about half years
+		if period == "every 6 months" {
+			period, amount = "yearly", amount*2
+		}
+		fmt.Fprintf(w, "%s custom \"budget\" %s \"%s\" %.2f %s\n", opened, fixedAccount(item), period, amount, currency)
+	}
+	if len(fixed) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, item := range entries {
+		fmt.Fprintf(w, "%s * %s%s\n", item.Date, beancountString(item.Description), beancountTags(item.Tags))
+		for _, posting := range entryPostings(item) {
+			fmt.Fprintf(w, "  %-40s %12.2f %s\n", posting.Mapping, -posting.Amount, currency)
+		}
+		fmt.Fprintf(w, "  %-40s %12.2f %s\n\n", asset, item.Amount, currency)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBeancountAsset(t *testing.T) {
+	tests := []struct {
+		account string
+		want    string
+	}{
+		{account: "Cash", want: "Assets:Cash"},
+		{account: "Bank:Savings", want: "Assets:Bank:Savings"},
+		{account: "Assets:Bank", want: "Assets:Bank"},
+		{account: "Liabilities:Visa", want: "Liabilities:Visa"},
+		{account: "Expenses", want: "Assets:Expenses"},
+		{account: "Incomes:Bank", want: "Assets:Incomes:Bank"},
+	}
+	for _, test := range tests {
+		t.Run(test.account, func(t *testing.T) {
+			if got := beancountAsset(test.account); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBeancountString(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "plain", s: "Lunch", want: `"Lunch"`},
+		{name: "quotes", s: `Say "hi"`, want: `"Say \"hi\""`},
+		{name: "backslashes", s: `C:\temp\`, want: `"C:\\temp\\"`},
+		{name: "escaped quote", s: `a\"b`, want: `"a\\\"b"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := beancountString(test.s); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEntryPostings(t *testing.T) {
+	tests := []struct {
+		name string
+		item Entry
+		want []Entry
+	}{
+		{name: "expense", item: Entry{Mapping: "eating out", Amount: -12.5},
+			want: []Entry{{Mapping: "Expenses:EatingOut", Amount: -12.5}}},
+		{name: "income", item: Entry{Mapping: "salary", Amount: 2000},
+			want: []Entry{{Mapping: "Income:Salary", Amount: 2000}}},
+		{name: "split expense", item: Entry{Amount: -30, Splits: []Split{{Amount: 20, Mapping: "Food"}, {Amount: 10}}},
+			want: []Entry{{Mapping: "Expenses:Food", Amount: -20}, {Mapping: "Expenses:" + uncategorised, Amount: -10}}},
+		{name: "split income", item: Entry{Amount: 100, Splits: []Split{{Amount: 60.25, Mapping: "Salary"}, {Amount: 39.75, Mapping: "Bonus"}}},
+			want: []Entry{{Mapping: "Income:Salary", Amount: 60.25}, {Mapping: "Income:Bonus", Amount: 39.75}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := entryPostings(test.item)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			var sum float64
+			for i := range got {
+				if got[i].Mapping != test.want[i].Mapping || got[i].Amount != test.want[i].Amount {
+					t.Errorf("got posting %v, want %v", got[i], test.want[i])
+				}
+				sum += got[i].Amount
+			}
+			if math.Abs(sum-test.item.Amount) > 0.005 {
+				t.Errorf("the postings add up to %.2f instead of %.2f", sum, test.item.Amount)
+			}
+		})
+	}
+}
+
+func TestWriteBeancount(t *testing.T) {
+	entries := []Entry{
+		{Date: "2026-10-01", Description: `Say "hi" C:\temp\`, Mapping: "Food", Amount: -5},
+		{Date: "2026-10-02", Description: "Market", Amount: -30, Tags: []string{"trip"},
+			Splits: []Split{{Amount: 20.5, Mapping: "Food"}, {Amount: 9.5, Mapping: "Home"}}},
+	}
+	var out bytes.Buffer
+	writeJournal(&out, "beancount", "bank", entries, nil)
+	journal := out.String()
+	for _, want := range []string{
+		"open Assets:Bank\n",
+		"2026-10-01 * \"Say \\\"hi\\\" C:\\\\temp\\\\\"\n",
+		"2026-10-02 * \"Market\" #trip\n",
+	} {
+		if !strings.Contains(journal, want) {
+			t.Errorf("%q is missing in\n%s", want, journal)
+		}
+	}
+	// Every transaction has to balance
+	var transactions int
+	for _, block := range strings.Split(journal, "\n\n") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if !strings.Contains(lines[0], " * ") {
+			continue
+		}
+		transactions++
+		var sum float64
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				t.Fatalf("malformed posting %q", line)
+			}
+			amount, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatalf("malformed amount in %q", line)
+			}
+			sum += amount
+		}
+		if math.Abs(sum) > 0.005 {
+			t.Errorf("%q doesn't balance: %.2f", lines[0], sum)
+		}
+	}
+	if transactions != len(entries) {
+		t.Errorf("got %d transactions, want %d", transactions, len(entries))
+	}
+}
@@ -5,42 +5,236 @@ This is a simple budgeting web app, based on the blog-post by Alex Recker:
 https://alexrecker.com/our-new-sid-meiers-civilization-inspired-budget.html
 
 To use, you simply compile and run the gofinance binary.
+The binary also works as a command line tool (commands in cli.go):
 
+	gofinance [flags] serve                      starts the web server (the default), with -tls-self-signed on HTTPS
+	gofinance [flags] add [-income] <amount> <description>
+	gofinance [flags] add -fixed -recurrence monthly <amount> <description>
+	gofinance [flags] today                      today's magic number and expenses
+	gofinance [flags] summary week|month|year    expenses of the period
+	gofinance [flags] categories [set <description> <category>]
+	gofinance [flags] backup                     writes a backup into the backup directory
+	gofinance [flags] restore <backup>           replaces the database with a backup (stop the server first)
+	gofinance [flags] users add <name>           adds a user who can sign in
+	gofinance [flags] budgets add <name> <owner> starts a budget, -budget picks the one a command works on
 */
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// The command line configuration shared by all commands
+var (
+	dbpath      = flag.String("db", "gofin.db", "path of the database")
+	backupDir   = flag.String("backup-dir", "backups", "directory for the backups")
+	backupEvery = flag.Duration("backup-every", 24*time.Hour, "interval of the scheduled backups while the server runs (0 disables them)")
+	backupKeep  = flag.Int("backup-keep", 7, "number of backups to keep (0 keeps all)")
+	// Attachments are stored in the database unless a directory is given
+	attachmentDir     = flag.String("attachment-dir", "", "directory for the attachment files (empty stores them in the database)")
+	attachmentMaxSize = flag.Int64("attachment-max-size", 10<<20, "maximum size of an attachment in bytes")
+	// Every page needs a signed in user, see auth.go
+	authMode      = flag.String("auth", "session", "how users sign in: session (login page), basic (HTTP basic auth) or proxy (user name from a reverse proxy)")
+	authHeader    = flag.String("auth-header", "X-Remote-User", "header with the name of the signed in user, set by the reverse proxy (proxy mode)")
+	authProxies   = flag.String("auth-proxies", "127.0.0.1,::1", "comma separated addresses or CIDR ranges of the trusted reverse proxies (proxy mode)")
+	sessionMaxAge = flag.Duration("session-max-age", 30*24*time.Hour, "how long a login lasts")
+	secureCookies = flag.Bool("secure-cookies", false, "send the cookies only over HTTPS, also without TLS here (behind an HTTPS reverse proxy)")
+	// Without a certificate the server speaks plain HTTP, see tls.go
+	addr         = flag.String("addr", ":8080", "address the web server listens on")
+	tlsCert      = flag.String("tls-cert", "", "certificate file (PEM) to serve HTTPS with, reloaded on SIGHUP")
+	tlsKey       = flag.String("tls-key", "", "key file (PEM) of the certificate")
+	tlsSelfSign  = flag.Bool("tls-self-signed", false, "serve HTTPS with a self-signed certificate, made on the first start (stored in -tls-cert and -tls-key, default gofinance.crt and gofinance.key)")
+	redirectAddr = flag.String("redirect-addr", "", "with HTTPS, also listen on this address with plain HTTP and redirect to HTTPS (e.g. :80)")
+	// Limits against slow and huge requests, see server.go
+	readTimeout     = flag.Duration("read-timeout", 2*time.Minute, "how long a client may take to send a request, including uploads")
+	writeTimeout    = flag.Duration("write-timeout", 2*time.Minute, "how long the server may take to send a response, including exports")
+	idleTimeout     = flag.Duration("idle-timeout", 2*time.Minute, "how long an idle keep-alive connection stays open")
+	maxBodySize     = flag.Int64("max-body-size", 1<<20, "maximum size of a request body in bytes, except uploads (see -attachment-max-size)")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long running requests may take to finish on SIGINT or SIGTERM")
+	// The web pages use the budget picked on the budgets page, see budgets.go
+	budgetName = flag.String("budget", "", "name or ID of the budget the commands work on (default the first one)")
+)
+
 func main() {
-	// Creates the table on first run if it doesn't exist
-	const dbpath = "gofin.db"
-	db = initDB(dbpath)
-	defer db.Close()
-	CreateTable(db)
+	flag.Usage = usage
+	flag.Parse()
+	command, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command:", command)
+		usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	// Restoring swaps the database file, so it must not be opened
+	if command != "restore" {
+		// Creates the table on first run if it doesn't exist
+		db = initDB(*dbpath)
+		defer db.Close()
+		CreateTable(ctx, db)
+		var err error
+		if cliBudget, err = findBudget(ctx, db, *budgetName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := run(ctx, args); err != nil {
+		log.Fatal(command, ": ", err)
+	}
+}
+
+// serve runs the web server - the default command
+func serve(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if !authModes[*authMode] {
+		return fmt.Errorf("unknown -auth %q, use session, basic or proxy", *authMode)
+	}
+	proxies, err := parseProxies(*authProxies)
+	if err != nil {
+		return err
+	}
+	if users, err := ReadUsers(ctx, db); err != nil {
+		return err
+	} else if len(users) == 0 {
+		log.Println("There are no users yet - add one with: gofinance users add <name>")
+	}
+	if *backupEvery > 0 {
+		backups, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			scheduleBackups(backups, db, *backupDir, *attachmentDir, *backupEvery, *backupKeep)
+			close(done)
+		}()
+		// A running backup finishes before the database is closed
+		defer func() {
+			stop()
+			<-done
+		}()
+	}
 	// Setting up the routes - handlers in handlers.go
 	router := httprouter.New()
+	router.ServeFiles("/static/*filepath", http.Dir("static"))
+	router.GET("/login", handleLogin)
+	router.POST("/login", login)
+	router.POST("/logout", logout)
+	router.GET("/budgets", handleBudgets)
+	router.POST("/confirm/budgets", newBudget)
+	router.POST("/confirm/budgets/switch/:id", switchBudget)
+	router.POST("/confirm/budgets/edit/:id", editBudget)
+	router.POST("/confirm/budgets/members/:id", editMember)
+	router.POST("/confirm/budgets/remove/:id", deleteMember)
 	router.GET("/", renderMain)
 	router.GET("/stats", handleStats)
 	router.GET("/new/transaction", renderInsert)
+	router.GET("/quickadd", handleQuickAdd)
 	router.GET("/new/fixed", renderNewFix)
 	router.GET("/edit/:type/:id", handleEdit)
+	router.GET("/split/:id", handleSplit)
+	router.GET("/share/:id", handleShare)
+	router.GET("/settle", handleSettle)
+	router.GET("/history/:type/:id", handleHistory)
+	router.GET("/activity", handleActivity)
 	router.GET("/stats/:type", handleStatsDetails)
 	router.GET("/categories", handleCats)
+	router.GET("/categories/manage", handleManageCategory)
+	router.GET("/rules", handleRules)
+	router.GET("/inbox", handleInbox)
+	router.GET("/tags", handleTags)
+	router.GET("/transactions", handleTransactions)
+	router.GET("/reports", handleReports)
+	router.GET("/accounts", handleAccounts)
+	router.GET("/accounts/:id", handleAccount)
+	router.GET("/accounts/:id/reconcile", handleReconcile)
 	router.GET("/summary/:type", handleSummaryDetails)
+	router.GET("/export/:format", handleExport)
 	router.POST("/confirm/new/transaction", getInput)
 	router.POST("/confirm/edit/:type/:id", editEntry)
+	router.POST("/confirm/split/:id", splitEntry)
+	router.POST("/confirm/share/:id", shareEntry)
+	router.POST("/confirm/settle", settleEntry)
+	router.GET("/attachments/:id", handleAttachment)
+	router.POST("/confirm/attach/:id", uploadAttachment)
+	router.POST("/confirm/attachments/delete/:id", deleteAttachment)
 	router.POST("/confirm/new/fixed", getFixInput)
+	router.POST("/confirm/accounts", newAccount)
+	router.POST("/confirm/accounts/edit/:id", editAccount)
+	router.POST("/confirm/accounts/delete/:id", deleteAccount)
+	router.POST("/confirm/transfers", newTransfer)
+	router.POST("/confirm/transfers/delete/:id", deleteTransfer)
+	router.POST("/confirm/reconcile/:id", reconcileEntry)
+	router.POST("/confirm/unlock/:id", unlockEntry)
 	router.POST("/confirm/categories", updateCats)
+	router.POST("/confirm/suggestion", acceptSuggestion)
+	router.POST("/confirm/categories/move", moveCategoryHandler)
+	router.POST("/confirm/categories/manage", manageCategory)
+	router.POST("/confirm/inbox", categorizeInbox)
+	router.POST("/confirm/rules", newRule)
+	router.POST("/confirm/rules/apply", applyRules)
+	router.POST("/confirm/rules/delete/:id", deleteRule)
+	router.POST("/api/quickadd", apiQuickAdd)
+	router.GET("/api/categories", apiCategories)
+	router.GET("/api/tags", apiTags)
+	router.GET("/api/transactions", apiTransactions)
+	router.GET("/api/reports", apiReports)
+	router.GET("/api/accounts", apiAccounts)
+	router.POST("/api/categories/:action", apiChangeCategory)
+	handler := healthChecks(followClient(limitBody(secureHeaders(requireCSRF(requireAuth(requireBudget(router), *authMode, proxies))))))
 	// Start the Webserver
-	fmt.Println("GoFinance has started successfully. Please visit http://localhost:8080/")
-	err := http.ListenAndServe(":8080", router)
+	server := newServer(*addr, handler)
+	if *tlsCert == "" && *tlsKey == "" && !*tlsSelfSign {
+		fmt.Println("GoFinance has started successfully. Please visit http://localhost" + *addr + "/")
+		err = runServers(server)
+	} else if err = configureTLS(server); err == nil {
+		fmt.Println("GoFinance has started successfully. Please visit https://localhost" + *addr + "/")
+		servers := []*http.Server{server}
+		if *redirectAddr != "" {
+			servers = append(servers, newServer(*redirectAddr, redirectToHTTPS(*addr)))
+		}
+		err = runServers(servers...)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Stopped the server, closing the database")
+	return nil
+}
+
+// configureTLS sets up a server for HTTPS, with a certificate that is reloaded on SIGHUP
+func configureTLS(server *http.Server) error {
+	certFile, keyFile := *tlsCert, *tlsKey
+	if *tlsSelfSign {
+		if certFile == "" {
+			certFile = "gofinance.crt"
+		}
+		if keyFile == "" {
+			keyFile = "gofinance.key"
+		}
+		if err := writeSelfSigned(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("HTTPS needs both -tls-cert and -tls-key")
+	}
+	reloader, err := loadCertificate(certFile, keyFile)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", router)
+		return err
 	}
+	go reloadOnHangup(reloader)
+	server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	return nil
 }
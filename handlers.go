@@ -5,77 +5,749 @@ package main
 
 import (
 	"database/sql"
-	"html/template"
+	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/sync/errgroup"
 )
 
 // Make the DB global for all
 var db *sql.DB
 
 // HandleStatsDetails handles the details page, where you can see all expenses.
+// The expenses can be limited to a tag with ?tag=
 func handleStatsDetails(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
-	t, _ := template.ParseFiles("templates/details.html", "templates/header.html")
-	data := SumByCats(db, pr.ByName("type"))
-	t.ExecuteTemplate(w, "details", map[string]interface{}{"data": data, "type": pr.ByName("type"), "mapping": false})
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, _ := parsePage(r, "templates/details.html", "templates/header.html")
+	category := pr.ByName("type")
+	tag := r.URL.Query().Get("tag")
+	data, err := SumByCats(ctx, db, budget, category, tag)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// Drill-down into the sub-categories, and the way back up
+	children, err := SumChildren(ctx, db, budget, category, tag)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var parents []string
+	if path, ok := categoryPaths(nodes)[category]; ok {
+		parents = strings.Split(path, ":")
+		parents = parents[:len(parents)-1]
+	}
+	tags, err := ReadAllTags(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "details", map[string]interface{}{"data": data, "type": category, "mapping": len(children) > 0,
+		"children": children, "parents": parents, "tag": tag, "tags": tags,
+		"browse": TransactionFilter{From: periodStart("year", time.Now()), Category: category, Tag: tag, Sort: "date", Desc: true, PerPage: defaultPerPage}})
 }
 
 func handleSummaryDetails(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
-	t, _ := template.ParseFiles("templates/details.html", "templates/header.html")
-	data := SumSummary(db, pr.ByName("type"))
-	t.ExecuteTemplate(w, "details", map[string]interface{}{"data": data, "type": pr.ByName("type"), "mapping": true})
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, _ := parsePage(r, "templates/details.html", "templates/header.html")
+	tag := r.URL.Query().Get("tag")
+	data, err := SumSummary(ctx, db, budget, pr.ByName("type"), tag)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	tags, err := ReadAllTags(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "details", map[string]interface{}{"data": data, "type": pr.ByName("type"), "mapping": true,
+		"tag": tag, "tags": tags,
+		"browse": TransactionFilter{From: periodStart(pr.ByName("type"), time.Now()), Tag: tag, Sort: "date", Desc: true, PerPage: defaultPerPage}})
+}
+
+// handleTransactions shows the transactions browser, filtered by the query (see parseTransactionFilter)
+func handleTransactions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/transactions.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	filter, errf := parseTransactionFilter(r.URL.Query())
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	tags, err := ReadAllTags(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data := map[string]interface{}{"filter": filter, "categories": sortTree(nodes), "tags": tags,
+		"uncategorised": uncategorised, "pages": 1}
+	if errf != nil {
+		data["error"] = errf.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		t.ExecuteTemplate(w, "transactions", data)
+		return
+	}
+	count, sum := CountTransactions(ctx, db, budget, filter)
+	transactions, err := SearchTransactions(ctx, db, budget, filter)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	pages := filter.Pages(count)
+	data["transactions"], data["count"], data["sum"], data["pages"] = transactions, count, sum, pages
+	if filter.Page > 1 {
+		data["prev"] = filter.Page - 1
+	}
+	if filter.Page < pages {
+		data["next"] = filter.Page + 1
+	}
+	t.ExecuteTemplate(w, "transactions", data)
+}
+
+// handleReports compares a month (?month=2006-01, the current one by default) with the month before
+// and the same month last year, and shows the trend of every category over ?months= months
+func handleReports(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/reports.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	month, err := parseReportMonth(r.URL.Query().Get("month"), time.Now())
+	if err == nil {
+		var months int
+		if months, err = parseReportMonths(r.URL.Query().Get("months")); err == nil {
+			report, err := buildReport(ctx, db, budget, month, months)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			t.ExecuteTemplate(w, "reports", map[string]interface{}{"report": report, "months": months})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	t.ExecuteTemplate(w, "reports", map[string]interface{}{"error": err.Error(), "months": defaultReportMonths})
+}
+
+// handleAccounts lists the accounts with their balances, with forms for new accounts and transfers
+func handleAccounts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	renderAccounts(w, r, currentBudget(r).ID, r.URL.Query().Get("error"))
+}
+
+// renderAccounts renders the accounts page with an optional error
+func renderAccounts(w http.ResponseWriter, r *http.Request, budget int, accountError string) {
+	t, err := parsePage(r, "templates/accounts.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	accounts, err := ReadAccounts(r.Context(), db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var total float64
+	for _, item := range accounts {
+		total += item.Balance
+	}
+	t.ExecuteTemplate(w, "accounts", map[string]interface{}{"accounts": accounts, "total": total, "kinds": accountKinds,
+		"date": time.Now().Format("2006-01-02"), "error": accountError})
+}
+
+// handleAccount shows the transactions and transfers of an account with the running balance, newest first
+func handleAccount(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/account.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	account := ReadAccount(ctx, db, budget, id)
+	if account.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	lines, err := accountRegister(ctx, db, budget, account)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	t.ExecuteTemplate(w, "account", map[string]interface{}{"account": account, "lines": lines, "kinds": accountKinds,
+		"error": r.URL.Query().Get("error")})
+}
+
+// handleReconcile shows the open lines of an account for a statement (?date= and ?balance=),
+// to tick off the cleared ones
+func handleReconcile(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	account := ReadAccount(ctx, db, budget, id)
+	if account.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	date, closing := r.URL.Query().Get("date"), r.URL.Query().Get("balance")
+	if date == "" && closing == "" {
+		renderReconcile(w, r, account, nil, "")
+		return
+	}
+	date, amount, err := parseStatement(date, closing)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderReconcile(w, r, account, nil, err.Error())
+		return
+	}
+	statement, err := readStatement(ctx, db, budget, account, date, amount)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	renderReconcile(w, r, account, &statement, "")
+}
+
+// renderReconcile renders the reconciliation of an account - without a statement only
+// the form asking for it
+func renderReconcile(w http.ResponseWriter, r *http.Request, account Account, statement *Statement, reconcileError string) {
+	t, err := parsePage(r, "templates/reconcile.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	t.ExecuteTemplate(w, "reconcile", map[string]interface{}{"account": account, "statement": statement,
+		"last": ReadLastReconciliation(r.Context(), db, account.ID), "error": reconcileError})
+}
+
+// reconcileEntry saves the cleared lines of a statement ("save") or finishes the reconciliation ("finish")
+func reconcileEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	account := ReadAccount(ctx, db, budget, id)
+	if account.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	r.ParseForm()
+	date, closing, err := parseStatement(r.FormValue("date"), r.FormValue("balance"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderReconcile(w, r, account, nil, err.Error())
+		return
+	}
+	statement, err := reconcileAccount(ctx, db, budget, account, date, closing, r.Form["cleared"], r.FormValue("action") == "finish")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderReconcile(w, r, account, &statement, err.Error())
+		return
+	}
+	if r.FormValue("action") == "finish" {
+		http.Redirect(w, r, "/accounts/"+pr.ByName("id"), 303)
+		return
+	}
+	http.Redirect(w, r, "/accounts/"+pr.ByName("id")+"/reconcile?"+url.Values{"date": {date}, "balance": {r.FormValue("balance")}}.Encode(), 303)
+}
+
+// unlockEntry takes a reconciled transaction out of its reconciliation, so it can be changed again
+func unlockEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if err := UnlockTransaction(ctx, db, budget, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/edit/transactions/"+pr.ByName("id"), 303)
+}
+
+// newAccount stores a new account from the form on the accounts page
+func newAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	item, err := parseAccount(r.FormValue("name"), r.FormValue("kind"), r.FormValue("opening"))
+	if err == nil {
+		_, err = saveAccount(ctx, db, budget, item)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderAccounts(w, r, budget, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/accounts", 303)
+}
+
+// editAccount changes the name, kind and opening balance of an account
+func editAccount(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	item, err := parseAccount(r.FormValue("name"), r.FormValue("kind"), r.FormValue("opening"))
+	if err == nil {
+		item.ID = id
+		_, err = saveAccount(ctx, db, budget, item)
+	}
+	if err != nil {
+		http.Redirect(w, r, "/accounts/"+pr.ByName("id")+"?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/accounts/"+pr.ByName("id"), 303)
+}
+
+// deleteAccount removes an account without transactions
+func deleteAccount(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if err := removeAccount(ctx, db, budget, id); err != nil {
+		http.Redirect(w, r, "/accounts/"+pr.ByName("id")+"?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/accounts", 303)
+}
+
+// newTransfer moves money between two accounts, from the form on the accounts page
+func newTransfer(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	amount, err := strconv.ParseFloat(r.FormValue("amount"), 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderAccounts(w, r, budget, "invalid amount")
+		return
+	}
+	from, _ := strconv.Atoi(r.FormValue("from"))
+	to, _ := strconv.Atoi(r.FormValue("to"))
+	item := Transfer{From: from, To: to, Amount: amount, Description: r.FormValue("description")}
+	if date := r.FormValue("date"); date != "" && date != time.Now().Format("2006-01-02") {
+		day, errd := time.ParseInLocation("2006-01-02", date, time.Local)
+		if errd != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			renderAccounts(w, r, budget, "invalid date")
+			return
+		}
+		item.Timestamp = atDate(day, time.Now())
+	}
+	if err := transferMoney(ctx, db, budget, currentUser(r), item); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderAccounts(w, r, budget, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/accounts", 303)
+}
+
+// deleteTransfer removes a transfer and goes back to the account it was deleted from
+func deleteTransfer(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if err := removeTransfer(ctx, db, budget, currentUser(r), id); err != nil {
+		http.Redirect(w, r, "/accounts/"+r.FormValue("account")+"?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/accounts/"+r.FormValue("account"), 303)
+}
+
+// handleTags shows the totals per tag between two dates (?from= and ?to=, both optional)
+func handleTags(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/tags.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	totals, err := SumTags(ctx, db, budget, from, to)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "tags", map[string]interface{}{"totals": totals, "from": from, "to": to})
+}
+
+// handleExport offers all transactions as a plain-text accounting journal.
+// The counter-posting goes to the asset account given as ?account=
+func handleExport(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	format := pr.ByName("format")
+	extension, ok := exportFormats[format]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	asset := r.URL.Query().Get("account")
+	if asset == "" {
+		asset = defaultAssetAccount
+	}
+	entries, err := ReadJournal(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	fixed, err := ReadItem(ctx, db, budget, "fixed")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=gofinance."+extension)
+	// Nested categories become nested accounts
+	paths := categoryPaths(nodes)
+	for i := range entries {
+		if path, ok := paths[entries[i].Mapping]; ok {
+			entries[i].Mapping = path
+		}
+		for j, split := range entries[i].Splits {
+			if path, ok := paths[split.Mapping]; ok {
+				entries[i].Splits[j].Mapping = path
+			}
+		}
+	}
+	writeJournal(w, format, asset, entries, fixed)
 }
 
 func handleCats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := template.ParseFiles("templates/editcategories.html", "templates/header.html")
-	items := getCategories(db)
-	t.ExecuteTemplate(w, "categories", items)
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, _ := parsePage(r, "templates/editcategories.html", "templates/header.html")
+	items, err := getCategories(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	suggestions, err := suggestCategories(ctx, db, budget, items)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "categories", map[string]interface{}{"cats": items, "suggestions": suggestions,
+		"tree": sortTree(nodes), "error": r.URL.Query().Get("error")})
 }
 
+// moveCategoryHandler moves a category with its sub-categories below another one
+func moveCategoryHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	parent, _ := strconv.Atoi(r.FormValue("parent"))
+	if err := moveCategory(ctx, db, budget, id, parent); err != nil {
+		http.Redirect(w, r, "/categories?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/categories", 303)
+}
+
+// acceptSuggestion categorizes a description with the suggested category (one-click accept)
+func acceptSuggestion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	description := r.FormValue("accept")
+	c, err := trainClassifier(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if suggestion, ok := c.suggestFor(description); ok {
+		if err := setMapping(ctx, db, budget, currentUser(r), description, suggestion.Mapping); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/categories", 303)
+}
+
+// updateCats stores the categories of the descriptions. The form holds the fields
+// id, description and mapping once per description, in the same order.
 func updateCats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
 	r.ParseForm()
+	ids, descriptions, mappings := r.PostForm["id"], r.PostForm["description"], r.PostForm["mapping"]
+	if len(ids) != len(descriptions) || len(ids) != len(mappings) {
+		http.Error(w, "malformed categories form", http.StatusBadRequest)
+		return
+	}
 	var cats []Category
-	for key, values := range r.Form { // range over map
-		keylist := strings.Split(key, "_")
-		for _, value := range values { // range over []string
-			var id int
-			if keylist[0] != "" {
-				id, _ = strconv.Atoi(keylist[0])
-			} else {
-				id = 0
-			}
-			nullID := ToNullInt64(id)
-			cats = append(cats, Category{ID: nullID, Description: keylist[1], Mapping: ToNullString(value)})
+	for i := range ids {
+		id, err := strconv.Atoi(ids[i])
+		if err != nil {
+			http.Error(w, "malformed categories form", http.StatusBadRequest)
+			return
 		}
+		mapping := strings.TrimSpace(mappings[i])
+		// Nothing to store for a description that stays uncategorised
+		if id == 0 && mapping == "" {
+			continue
+		}
+		cats = append(cats, Category{ID: ToNullInt64(id), Description: descriptions[i], Mapping: ToNullString(mapping)})
+	}
+	if err := UpdateCats(ctx, db, budget, currentUser(r), cats); err != nil {
+		serverError(w, r, err)
+		return
 	}
-	UpdateCats(db, cats)
 	http.Redirect(w, r, "/", 301)
 }
 
+// handleManageCategory shows what renaming, merging or deleting a category would affect.
+// With action (and target) given, it asks for confirmation.
+func handleManageCategory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	renderManageCategory(w, r, currentBudget(r).ID, query.Get("name"), query.Get("action"), query.Get("target"), "")
+}
+
+// renderManageCategory renders the page to manage a single category
+func renderManageCategory(w http.ResponseWriter, r *http.Request, budget int, name, action, target, manageError string) {
+	t, err := parsePage(r, "templates/managecategory.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	ctx := r.Context()
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if _, ok := findCategory(nodes, name); !ok {
+		http.Error(w, "unknown category", http.StatusNotFound)
+		return
+	}
+	if manageError == "" && action != "" {
+		if errc := checkCategoryChange(nodes, action, name, target); errc != nil {
+			manageError, action = errc.Error(), ""
+		}
+	}
+	t.ExecuteTemplate(w, "managecategory", map[string]interface{}{"name": name, "usage": ReadCategoryUsage(ctx, db, budget, name),
+		"tree": sortTree(nodes), "action": action, "target": target, "error": manageError})
+}
+
+// manageCategory renames, merges or deletes a category after confirmation
+func manageCategory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	name, action, target := r.FormValue("name"), r.FormValue("action"), r.FormValue("target")
+	if err := changeCategory(ctx, db, budget, currentUser(r), action, name, target); err != nil {
+		renderManageCategory(w, r, budget, name, "", target, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/categories", 303)
+}
+
+// handleRules shows the categorisation rules with a preview of the transactions they affect
+func handleRules(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	renderRules(w, r, currentBudget(r).ID, r.URL.Query().Get("message"), "")
+}
+
+// renderRules renders the rules page with an optional message or error
+func renderRules(w http.ResponseWriter, r *http.Request, budget int, message, ruleError string) {
+	t, err := parsePage(r, "templates/rules.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	rules, err := ReadRules(r.Context(), db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	preview, err := previewRules(r.Context(), db, budget, rules)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "rules", map[string]interface{}{"rules": rules, "preview": preview,
+		"kinds": ruleKinds, "message": message, "error": ruleError})
+}
+
+// newRule stores a new categorisation rule from the form on the rules page
+func newRule(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	r.ParseForm()
+	priority, _ := strconv.Atoi(r.FormValue("priority"))
+	rule := Rule{Priority: priority, Kind: r.FormValue("kind"), Pattern: r.FormValue("pattern"),
+		Mapping: strings.TrimSpace(r.FormValue("mapping"))}
+	var erra error
+	if min := r.FormValue("min"); min != "" {
+		rule.Min.Float64, erra = strconv.ParseFloat(min, 64)
+		rule.Min.Valid = erra == nil
+	}
+	if max := r.FormValue("max"); max != "" && erra == nil {
+		rule.Max.Float64, erra = strconv.ParseFloat(max, 64)
+		rule.Max.Valid = erra == nil
+	}
+	if erra != nil {
+		renderRules(w, r, budget, "", "invalid amount")
+		return
+	}
+	if err := rule.validate(); err != nil {
+		renderRules(w, r, budget, "", err.Error())
+		return
+	}
+	if err := StoreRule(ctx, db, budget, rule); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/rules", 303)
+}
+
+// deleteRule removes a categorisation rule
+func deleteRule(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	if err := DeleteRule(ctx, db, budget, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/rules", 303)
+}
+
+// applyRules re-applies all rules to the existing transactions
+func applyRules(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	changed, err := reapplyRules(ctx, db, budget, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/rules?message="+strconv.Itoa(changed)+"+descriptions+recategorized", 303)
+}
+
+// handleInbox lists all uncategorised transactions for triage
+func handleInbox(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/inbox.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	items, err := ReadUncategorised(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// Suggest a category for every transaction, as a hint
+	c, err := trainClassifier(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	nodes, err := ReadCategoryTree(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	suggestions := make(map[int]Suggestion)
+	for _, item := range items {
+		if suggestion, ok := c.suggest(item.Description, item.Amount); ok {
+			suggestions[item.ID] = suggestion
+		}
+	}
+	t.ExecuteTemplate(w, "inbox", map[string]interface{}{"items": items, "suggestions": suggestions,
+		"categories": sortTree(nodes), "message": r.URL.Query().Get("message")})
+}
+
+// categorizeInbox assigns a category to the descriptions of all selected transactions
+func categorizeInbox(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	r.ParseForm()
+	category := strings.TrimSpace(r.FormValue("category"))
+	var ids []int
+	for _, value := range r.PostForm["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "malformed inbox form", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if category == "" || len(ids) == 0 {
+		http.Redirect(w, r, "/inbox?message="+url.QueryEscape("Select transactions and enter a category"), 303)
+		return
+	}
+	descriptions, err := readDescriptions(ctx, db, budget, ids)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, description := range descriptions {
+		if err := setMapping(ctx, db, budget, currentUser(r), description, category); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	message := strconv.Itoa(len(descriptions)) + " descriptions categorized as " + category
+	http.Redirect(w, r, "/inbox?message="+url.QueryEscape(message), 303)
+}
+
 func handleStats(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
-	t, _ := template.ParseFiles("templates/stats.html", "templates/header.html")
-	// Get labels and values for stats concurrently
-	daylabelchan := make(chan []string)
-	typelabelchan := make(chan []string)
-	monlabelchan := make(chan []string)
-	dayvalchan := make(chan []float64)
-	typevalchan := make(chan []float64)
-	monvalchan := make(chan []float64)
-	go sumUp(db, "daily", daylabelchan, dayvalchan)
-	go sumUp(db, "type", typelabelchan, typevalchan)
-	go sumUp(db, "monthly", monlabelchan, monvalchan)
-	dayLabels := <-daylabelchan
-	dayValues := <-dayvalchan
-	typeLabels := <-typelabelchan
-	typeValues := <-typevalchan
-	monLabels := <-monlabelchan
-	monValues := <-monvalchan
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, _ := parsePage(r, "templates/stats.html", "templates/header.html")
+	tag, year := r.URL.Query().Get("tag"), r.URL.Query().Get("year")
+	from, to, err := statsRange(year, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Get labels and values for stats concurrently - the first error cancels the others
+	var dayLabels, typeLabels, monLabels []string
+	var dayValues, typeValues, monValues []float64
+	var magicNumber float64
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		dayLabels, dayValues, err = sumUp(gctx, db, budget, "daily", tag, "", "")
+		return err
+	})
+	g.Go(func() (err error) {
+		typeLabels, typeValues, err = sumUp(gctx, db, budget, "type", tag, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		return err
+	})
+	g.Go(func() (err error) {
+		monLabels, monValues, err = sumUp(gctx, db, budget, "monthly", tag, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		return err
+	})
+	g.Go(func() (err error) {
+		magicNumber, err = baseMagic(gctx, db, budget)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		serverError(w, r, err)
+		return
+	}
 	// Calculate the correct numbers by day
-	magicNumber := baseMagic(db)
 	for i := 0; i < len(dayValues); i++ {
 		dayValues[i] = magicNumber - (dayValues[i] * -1)
 	}
@@ -99,39 +771,153 @@ func handleStats(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
 		percentage := percentages(totalamount, typeValues[i])
 		catList = append(catList, category{Descr: typeLabels[i], Val: typeValues[i], Percent: percentage})
 	}
-	for i, val := range monLabels {
-		monInt, _ := strconv.Atoi(val)
-		numdays := daysInMonth(time.Now().Year(), time.Month(monInt))
-		monValues[i] = monValues[i] + float64(numdays)*magicNumber
+	monthSums := make(map[string]float64)
+	for i, month := range monLabels {
+		monthSums[month] = monValues[i]
+	}
+	monLabels, monValues = savedPerMonth(from, to, time.Now(), magicNumber, monthSums)
+	tags, err := ReadAllTags(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	years, err := ReadYears(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
 	}
 	t.ExecuteTemplate(w, "stats", map[string]interface{}{"dayLabels": dayLabels, "dayValues": dayValues,
-		"magicnumber": magicNumber, "types": catList, "monLabels": monLabels, "monValues": monValues})
+		"magicnumber": magicNumber, "types": catList, "monLabels": monLabels, "monValues": monValues,
+		"tag": tag, "tags": tags, "year": year, "years": years})
 }
 
 func handleEdit(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
-	t, _ := template.ParseFiles("templates/edit.html", "templates/header.html")
+	ctx := r.Context()
+	if !itemTypes[pr.ByName("type")] {
+		http.NotFound(w, r)
+		return
+	}
+	budget := currentBudget(r).ID
+	t, _ := parsePage(r, "templates/edit.html", "templates/header.html")
 	entryID := pr.ByName("id")
 	var entry int
 	entry, _ = strconv.Atoi(entryID)
-	trans := getSingle(db, entry, pr.ByName("type"))
+	trans, err := getSingle(ctx, db, budget, entry, pr.ByName("type"))
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
 	if trans.Amount < 0 {
 		trans.Amount = trans.Amount * -1
 	}
 	var fixcheck bool
+	var attachments []Attachment
+	var lock string
 	if pr.ByName("type") == "fixed" {
 		fixcheck = true
+	} else {
+		attachments, err = ReadAttachments(ctx, db, budget, entry)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		lock = ReadLock(ctx, db, entry)
+	}
+	members, err := ReadMembers(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var paidBy string
+	for _, member := range members {
+		if member.ID == trans.PaidBy {
+			paidBy = member.Name
+		}
+	}
+	accounts, err := ReadAccounts(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "edit", map[string]interface{}{"trans": trans, "transtype": pr.ByName("type"), "fixcheck": fixcheck,
+		"attachments": attachments, "maxsize": Attachment{Size: *attachmentMaxSize}.SizeText(), "error": r.URL.Query().Get("error"),
+		"accounts": accounts, "locked": lock, "paidby": paidBy})
+}
+
+// handleAttachment shows an attachment in the browser
+func handleAttachment(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	item, data, err := attachmentContent(ctx, db, budget, *attachmentDir, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", item.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+strings.Replace(item.Filename, "\"", "", -1)+"\"")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
+
+// uploadAttachment attaches an uploaded file (form field file) to a transaction
+func uploadAttachment(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id := pr.ByName("id")
+	idint, _ := strconv.Atoi(id)
+	// Leave some room for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, *attachmentMaxSize+1<<16)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Redirect(w, r, "/edit/transactions/"+id+"?error="+url.QueryEscape("no file or the file is too large"), 303)
+		return
+	}
+	defer file.Close()
+	data, contentType, err := readUpload(file, *attachmentMaxSize)
+	if err == nil {
+		err = attachFile(ctx, db, budget, currentUser(r), *attachmentDir, idint, header.Filename, data, contentType)
+	}
+	if err != nil {
+		http.Redirect(w, r, "/edit/transactions/"+id+"?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/edit/transactions/"+id, 303)
+}
+
+// deleteAttachment removes an attachment and goes back to its transaction
+func deleteAttachment(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	item, _ := ReadAttachment(ctx, db, budget, id)
+	if err := removeAttachment(ctx, db, budget, currentUser(r), *attachmentDir, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	t.ExecuteTemplate(w, "edit", map[string]interface{}{"trans": trans, "transtype": pr.ByName("type"), "fixcheck": fixcheck})
+	http.Redirect(w, r, "/edit/transactions/"+strconv.Itoa(item.TransactionID), 303)
 }
 
 func editEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	if !itemTypes[pr.ByName("type")] {
+		http.NotFound(w, r)
+		return
+	}
+	budget := currentBudget(r).ID
 	r.ParseForm()
 	income := false
-	description := r.Form["description"][0]
-	amountstr := r.Form["amount"][0]
-	amount, erra := strconv.ParseFloat(amountstr, 64)
+	description := r.FormValue("description")
+	idstr := pr.ByName("id")
+	idint, _ := strconv.Atoi(idstr)
+	amount, erra := strconv.ParseFloat(r.FormValue("amount"), 64)
 	if erra != nil {
-		panic(erra)
+		http.Redirect(w, r, "/edit/"+pr.ByName("type")+"/"+idstr+"?error="+url.QueryEscape("invalid amount"), 303)
+		return
 	}
 	incomecheck := r.Form["income"]
 	if len(incomecheck) == 0 {
@@ -141,23 +927,260 @@ func editEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
 	}
 	recurrence := ""
 	if pr.ByName("type") == "fixed" {
-		recurrence = strings.ToLower(r.Form["recurrence"][0])
+		recurrence = strings.ToLower(r.FormValue("recurrence"))
+	}
+	account, _ := strconv.Atoi(r.FormValue("account"))
+	errc := ChangeItem(ctx, db, budget, currentUser(r), Transaction{ID: idint, Description: description, Amount: amount, Income: income, Recurrence: recurrence,
+		Tags: parseTags(r.FormValue("tags")), Note: strings.TrimSpace(r.FormValue("note")), Account: account}, pr.ByName("type"))
+	if errc != nil {
+		http.Redirect(w, r, "/edit/"+pr.ByName("type")+"/"+idstr+"?error="+url.QueryEscape(errc.Error()), 303)
+		return
+	}
+	// A new amount has to be divided among the parts again
+	if pr.ByName("type") == "transactions" {
+		splits, err := ReadSplits(ctx, db, budget, idint)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if errs := checkSplits(amount, splits); errs != nil {
+			http.Redirect(w, r, "/split/"+idstr+"?error="+url.QueryEscape(errs.Error()), 303)
+			return
+		}
+		_, shares, err := ReadShares(ctx, db, budget, idint)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if errs := checkShares(amount, shares); errs != nil {
+			http.Redirect(w, r, "/share/"+idstr+"?error="+url.QueryEscape(errs.Error()), 303)
+			return
+		}
 	}
-	idstr := pr.ByName("id")
-	idint, _ := strconv.Atoi(idstr)
-	ChangeItem(db, Transaction{ID: idint, Description: description, Amount: amount, Income: income, Recurrence: recurrence}, pr.ByName("type"))
 	// Get back to the main page
 	http.Redirect(w, r, "/", 301)
 }
 
+// handleSplit shows the parts of a transaction, to split it into several categories
+func handleSplit(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	trans, err := getSingle(ctx, db, budget, id, "transactions")
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	renderSplit(w, r, budget, trans, trans.Splits, r.URL.Query().Get("error"))
+}
+
+// renderSplit renders the split form, with a few empty rows for new parts
+func renderSplit(w http.ResponseWriter, r *http.Request, budget int, trans Transaction, splits []Split, splitError string) {
+	t, err := parsePage(r, "templates/split.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	if trans.Amount < 0 {
+		trans.Amount = -trans.Amount
+	}
+	// Without parts, start with the whole amount in the category of the description
+	if len(splits) == 0 {
+		cats, err := getCategories(r.Context(), db, budget)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		var mapping string
+		for _, cat := range cats {
+			if cat.Description == trans.Description {
+				mapping = cat.Mapping.String
+			}
+		}
+		splits = []Split{{Amount: trans.Amount, Mapping: mapping}}
+	}
+	for len(splits) < 5 {
+		splits = append(splits, Split{})
+	}
+	tree, err := ReadCategoryTree(r.Context(), db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "split", map[string]interface{}{"trans": trans, "splits": splits,
+		"categories": sortTree(tree), "error": splitError})
+}
+
+// splitEntry stores the parts of a transaction. The form holds the fields
+// amount and mapping once per part, in the same order.
+func splitEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	r.ParseForm()
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	splits, err := parseSplits(r.PostForm["amount"], r.PostForm["mapping"])
+	if err == nil && r.FormValue("unsplit") != "" {
+		splits = nil
+	}
+	if err == nil {
+		err = splitTransaction(ctx, db, budget, currentUser(r), id, splits)
+	}
+	if err != nil {
+		trans, errs := getSingle(ctx, db, budget, id, "transactions")
+		if errors.Is(errs, errNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if errs != nil {
+			serverError(w, r, errs)
+			return
+		}
+		renderSplit(w, r, budget, trans, splits, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/", 303)
+}
+
+// handleShare shows who paid a transaction and how it is shared among the members
+func handleShare(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	trans, err := getSingle(ctx, db, budget, id, "transactions")
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	renderShare(w, r, budget, trans, "exact", r.URL.Query().Get("error"))
+}
+
+// renderShare renders the share form, with the current shares as exact amounts
+func renderShare(w http.ResponseWriter, r *http.Request, budget int, trans Transaction, mode, shareError string) {
+	t, err := parsePage(r, "templates/share.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	if trans.Amount < 0 {
+		trans.Amount = trans.Amount * -1
+	}
+	shares := make(map[int]float64)
+	for _, share := range trans.Shares {
+		shares[share.ID] = share.Amount
+	}
+	if len(trans.Shares) == 0 {
+		mode = "equal"
+	}
+	members, err := ReadMembers(r.Context(), db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "share", map[string]interface{}{"trans": trans, "members": members,
+		"shares": shares, "modes": shareModes, "mode": mode, "error": shareError})
+}
+
+// shareEntry stores who paid a transaction and how it is shared. The form holds the
+// fields member and value once per member, and with for the members who share it.
+func shareEntry(w http.ResponseWriter, r *http.Request, pr httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	r.ParseForm()
+	id, _ := strconv.Atoi(pr.ByName("id"))
+	trans, err := getSingle(ctx, db, budget, id, "transactions")
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	mode := r.FormValue("mode")
+	with := make(map[string]bool)
+	for _, name := range r.PostForm["with"] {
+		with[name] = true
+	}
+	var names, values []string
+	members, memberValues := r.PostForm["member"], r.PostForm["value"]
+	for i := 0; i < len(members) && i < len(memberValues); i++ {
+		if with[members[i]] {
+			names = append(names, members[i])
+			values = append(values, memberValues[i])
+		}
+	}
+	var shares []Share
+	if r.FormValue("unshare") == "" && len(names) > 0 {
+		shares, err = parseShares(mode, trans.Amount, names, values)
+	}
+	payer := r.FormValue("paid_by")
+	if r.FormValue("unshare") != "" {
+		payer = ""
+	}
+	if err == nil {
+		err = shareTransaction(ctx, db, budget, currentUser(r), id, payer, shares)
+	}
+	if err != nil {
+		renderShare(w, r, budget, trans, mode, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/edit/transactions/"+pr.ByName("id"), 303)
+}
+
+// handleSettle shows who owes whom in the budget and the payments to settle up
+func handleSettle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/settle.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	balances, err := ReadBalances(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	settlements, err := ReadSettlements(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	members, err := ReadMembers(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "settle", map[string]interface{}{"balances": balances, "payments": settleUp(balances),
+		"settlements": settlements, "members": members, "error": r.URL.Query().Get("error")})
+}
+
+// settleEntry records a payment between two members (form values from, to and amount)
+func settleEntry(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	if err := recordSettlement(ctx, db, budget, r.FormValue("from"), r.FormValue("to"), r.FormValue("amount")); err != nil {
+		http.Redirect(w, r, "/settle?error="+url.QueryEscape(err.Error()), 303)
+		return
+	}
+	http.Redirect(w, r, "/settle", 303)
+}
+
 func getInput(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
 	r.ParseForm()
 	income := false
-	description := r.Form["description"][0]
-	amountstr := r.Form["amount"][0]
-	amount, erra := strconv.ParseFloat(amountstr, 64)
+	description := r.FormValue("description")
+	amount, erra := strconv.ParseFloat(r.FormValue("amount"), 64)
 	if erra != nil {
-		panic(erra)
+		http.Error(w, "invalid amount", http.StatusBadRequest)
+		return
 	}
 	incomecheck := r.Form["income"]
 	if len(incomecheck) == 0 {
@@ -165,20 +1188,44 @@ func getInput(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	} else {
 		income = true
 	}
-	StoreItem(db, Transaction{Description: description, Amount: amount, Income: income}, "transaction")
+	// The date is optional - without it the transaction is from right now
+	var timestamp time.Time
+	if date := r.FormValue("date"); date != "" && date != time.Now().Format("2006-01-02") {
+		day, errd := time.ParseInLocation("2006-01-02", date, time.Local)
+		if errd != nil {
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return
+		}
+		timestamp = atDate(day, time.Now())
+	}
+	account, _ := strconv.Atoi(r.FormValue("account"))
+	_, err := StoreItem(ctx, db, budget, currentUser(r), Transaction{Description: description, Amount: amount, Income: income, Timestamp: timestamp,
+		Tags: parseTags(r.FormValue("tags")), Note: strings.TrimSpace(r.FormValue("note")), Account: account}, "transaction")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if category := strings.TrimSpace(r.FormValue("category")); category != "" {
+		if err := setMapping(ctx, db, budget, currentUser(r), description, category); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
 	// Get back to the main page
 	http.Redirect(w, r, "/", 301)
 }
 
 func getFixInput(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
 	r.ParseForm()
 	income := false
-	description := r.Form["description"][0]
-	amountstr := r.Form["amount"][0]
-	recurrence := r.Form["recurrence"][0]
-	amount, erra := strconv.ParseFloat(amountstr, 64)
+	description := r.FormValue("description")
+	recurrence := r.FormValue("recurrence")
+	amount, erra := strconv.ParseFloat(r.FormValue("amount"), 64)
 	if erra != nil {
-		panic(erra)
+		http.Error(w, "invalid amount", http.StatusBadRequest)
+		return
 	}
 	incomecheck := r.Form["income"]
 	if len(incomecheck) == 0 {
@@ -187,48 +1234,141 @@ func getFixInput(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		income = true
 	}
 	influence := calcRate(Transaction{Recurrence: recurrence, Amount: amount, Income: income})
-	StoreItem(db, Transaction{Description: description, Amount: amount, Income: income, Recurrence: recurrence, Influence: influence}, "fixed")
+	_, err := StoreItem(ctx, db, budget, currentUser(r), Transaction{Description: description, Amount: amount, Income: income, Recurrence: recurrence, Influence: influence}, "fixed")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
 	// Get back to the main page
 	http.Redirect(w, r, "/", 301)
 }
 
 // Handler to display the main page - with db-values
 func renderMain(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, err := template.ParseFiles("templates/index.html", "templates/header.html")
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/index.html", "templates/header.html")
 	if err != nil {
 		panic(err)
 	}
 	// Read the Database to get the current stuff (Date = today)
-	fixed := ReadItem(db, "fixed")
-	trans := ReadItem(db, "transaction")
-	magicNumber := baseMagic(db)
-	currentNumber := currentMagic(db)
-	weekchan := make(chan float64)
-	monthchan := make(chan float64)
-	yearchan := make(chan float64)
-	go expensesPerPeriod("week", weekchan)
-	go expensesPerPeriod("month", monthchan)
-	go expensesPerPeriod("year", yearchan)
-	weektotal := <-weekchan
-	monthtotal := <-monthchan
-	yeartotal := <-yearchan
+	var fixed, trans, uncategorised []Transaction
+	var members []Member
+	var magicNumber, currentNumber, personal, weektotal, monthtotal, yeartotal float64
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		fixed, err = ReadItem(gctx, db, budget, "fixed")
+		return err
+	})
+	g.Go(func() (err error) {
+		trans, err = ReadItem(gctx, db, budget, "transaction")
+		return err
+	})
+	g.Go(func() (err error) {
+		uncategorised, err = ReadUncategorised(gctx, db, budget)
+		return err
+	})
+	g.Go(func() (err error) {
+		members, err = ReadMembers(gctx, db, budget)
+		return err
+	})
+	g.Go(func() (err error) {
+		currentNumber, err = currentMagic(gctx, db, budget)
+		return err
+	})
+	g.Go(func() (err error) {
+		personal, err = personalMagic(gctx, db, budget, currentUser(r).ID)
+		return err
+	})
+	g.Go(func() (err error) {
+		magicNumber, err = baseMagic(gctx, db, budget)
+		return err
+	})
+	g.Go(func() (err error) {
+		weektotal, err = expensesPerPeriod(gctx, budget, "week")
+		return err
+	})
+	g.Go(func() (err error) {
+		monthtotal, err = expensesPerPeriod(gctx, budget, "month")
+		return err
+	})
+	g.Go(func() (err error) {
+		yeartotal, err = expensesPerPeriod(gctx, budget, "year")
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		serverError(w, r, err)
+		return
+	}
 	t.ExecuteTemplate(w, "index", map[string]interface{}{"fix": fixed, "tran": trans,
 		"mn": magicNumber, "curr": currentNumber,
-		"weektotal": weektotal, "monthtotal": monthtotal, "yeartotal": yeartotal})
+		"weektotal": weektotal, "monthtotal": monthtotal, "yeartotal": yeartotal,
+		"uncategorised": len(uncategorised), "shared": len(members) > 1, "personal": personal})
 }
 
 // Handler for the insertion
 func renderInsert(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, err := template.ParseFiles("templates/input.html", "templates/header.html")
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/input.html", "templates/header.html")
 	if err != nil {
 		panic(err)
 	}
-	t.ExecuteTemplate(w, "input", "")
+	accounts, err := ReadAccounts(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	t.ExecuteTemplate(w, "input", map[string]interface{}{"date": time.Now().Format("2006-01-02"), "accounts": accounts})
+}
+
+// handleQuickAdd shows the interpretation of a quick-add line in the input form,
+// so it can be checked (and corrected) before saving
+func handleQuickAdd(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	budget := currentBudget(r).ID
+	t, err := parsePage(r, "templates/input.html", "templates/header.html")
+	if err != nil {
+		panic(err)
+	}
+	accounts, err := ReadAccounts(ctx, db, budget)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	line := r.URL.Query().Get("q")
+	quick, errq := parseQuickAdd(line, time.Now())
+	data := map[string]interface{}{"quick": line, "date": time.Now().Format("2006-01-02"), "accounts": accounts}
+	if errq != nil {
+		data["error"] = errq.Error()
+	} else {
+		data["trans"] = quick.Transaction
+		data["category"] = quick.Category
+		data["date"] = quick.Date()
+		data["tags"] = strings.Join(quick.Tags, ", ")
+		// Without a category given, fill in the suggested one
+		if quick.Category == "" {
+			amount := quick.Amount
+			if !quick.Income {
+				amount = -amount
+			}
+			classifier, err := trainClassifier(ctx, db, budget)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if suggestion, ok := classifier.suggest(quick.Description, amount); ok {
+				data["category"] = suggestion.Mapping
+				data["suggestion"] = suggestion
+			}
+		}
+	}
+	t.ExecuteTemplate(w, "input", data)
 }
 
 // Handler for the insertion
 func renderNewFix(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, err := template.ParseFiles("templates/inputfix.html", "templates/header.html")
+	t, err := parsePage(r, "templates/inputfix.html", "templates/header.html")
 	if err != nil {
 		panic(err)
 	}
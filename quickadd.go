@@ -0,0 +1,152 @@
+/*
+This file holds the quick-add parser, which turns a single line like
+"12.50 lunch yesterday" or "+2000 bonus" into a transaction
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuickAdd is the interpretation of a quick-add line, shown before it is saved
+type QuickAdd struct {
+	Transaction
+	Category string
+}
+
+// Date returns the day of the transaction as 2006-01-02
+func (q QuickAdd) Date() string {
+	return q.Timestamp.Format("2006-01-02")
+}
+
+// Units understood in "<n> <unit> ago", as days
+var quickAddUnits = map[string]int{
+	"day": 1, "days": 1,
+	"week": 7, "weeks": 7,
+}
+
+// quickAmount matches the amounts of the quick-add box: plain decimals with up to two
+// decimal places, so "1,000", "1e5" or "inf" stay part of the description
+var quickAmount = regexp.MustCompile(`^[+-]?\d+([.,]\d{1,2})?$`)
+
+// parseQuickAdd interprets a quick-add line. The line consists of
+//   - an amount; a leading "+" makes it an income ("+2000 bonus")
+//   - an optional category, marked with "@" ("@groceries")
+//   - optional tags, marked with "#" ("#vacation-italy")
+//   - an optional date: "today", "yesterday", "3 days ago", "2 weeks ago",
+//     "2016-10-31" or "31.10.2016"
+//   - everything else is the description
+//
+// The order doesn't matter. now is the point in time "today" refers to.
+func parseQuickAdd(line string, now time.Time) (QuickAdd, error) {
+	var result QuickAdd
+	result.Timestamp = now
+	tokens := strings.Fields(line)
+	var description []string
+	amountFound := false
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		lower := strings.ToLower(token)
+		// "3 days ago"
+		if i+2 < len(tokens) && strings.ToLower(tokens[i+2]) == "ago" {
+			n, err := strconv.Atoi(token)
+			unit, ok := quickAddUnits[strings.ToLower(tokens[i+1])]
+			if err == nil && ok {
+				result.Timestamp = now.AddDate(0, 0, -n*unit)
+				i += 2
+				continue
+			}
+		}
+		switch {
+		case lower == "today":
+			result.Timestamp = now
+		case lower == "yesterday":
+			result.Timestamp = now.AddDate(0, 0, -1)
+		case strings.HasPrefix(token, "@") && len(token) > 1:
+			result.Category = token[1:]
+		case strings.HasPrefix(token, "#") && len(token) > 1:
+			if tag := normalizeTag(token); tag != "" {
+				result.Tags = append(result.Tags, tag)
+			}
+		default:
+			if day, ok := parseQuickDate(token, now); ok {
+				result.Timestamp = day
+				continue
+			}
+			if !amountFound {
+				if amount, income, err := parseQuickAmount(token); err == nil {
+					result.Amount = amount
+					result.Income = income
+					amountFound = true
+					continue
+				}
+			}
+			description = append(description, token)
+		}
+	}
+	if !amountFound {
+		return result, errors.New("no amount found")
+	}
+	if len(description) == 0 {
+		return result, errors.New("no description found")
+	}
+	result.Description = strings.Join(description, " ")
+	return result, nil
+}
+
+// storeQuickAdd saves an interpreted quick-add line of a user into a budget, including its category
+func storeQuickAdd(ctx context.Context, budget int, user User, quick QuickAdd) error {
+	if _, err := StoreItem(ctx, db, budget, user, quick.Transaction, "transaction"); err != nil {
+		return err
+	}
+	if quick.Category != "" {
+		return setMapping(ctx, db, budget, user, quick.Description, quick.Category)
+	}
+	return nil
+}
+
+// parseQuickAmount parses amounts like "12.50", "12,50", "+2000" or "-4".
+// Returns the absolute amount and whether it is an income.
+func parseQuickAmount(token string) (float64, bool, error) {
+	if !quickAmount.MatchString(token) {
+		return 0, false, errors.New("not an amount")
+	}
+	income := strings.HasPrefix(token, "+")
+	amount, err := strconv.ParseFloat(strings.Replace(strings.TrimPrefix(token, "+"), ",", ".", 1), 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return 0, false, errors.New("not a finite amount")
+	}
+	if amount < 0 {
+		amount = -amount
+	}
+	return amount, income, nil
+}
+
+// parseQuickDate parses "2016-10-31", "31.10.2016" and "31.10." (this year).
+// The time of day is taken from now, so the entries keep their order.
+func parseQuickDate(token string, now time.Time) (time.Time, bool) {
+	if strings.Count(token, ".") == 2 && strings.HasSuffix(token, ".") {
+		token += strconv.Itoa(now.Year())
+	}
+	for _, layout := range []string{"2006-01-02", "2.1.2006"} {
+		day, err := time.ParseInLocation(layout, token, now.Location())
+		if err == nil {
+			return atDate(day, now), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// atDate returns the given day at the time of day of now
+func atDate(day, now time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), now.Hour(), now.Minute(), now.Second(), 0, now.Location())
+}
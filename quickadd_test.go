@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuickAdd(t *testing.T) {
+	now := time.Date(2026, 10, 19, 14, 30, 0, 0, time.Local)
+	tests := []struct {
+		name        string
+		line        string
+		description string
+		amount      float64
+		income      bool
+		date        string
+		category    string
+		tags        []string
+		err         string
+	}{
+		{name: "amount with a point", line: "12.50 lunch", description: "lunch", amount: 12.5, date: "2026-10-19"},
+		{name: "amount with a comma", line: "lunch 12,50", description: "lunch", amount: 12.5, date: "2026-10-19"},
+		{name: "whole amount", line: "4 coffee", description: "coffee", amount: 4, date: "2026-10-19"},
+		{name: "minus is an expense", line: "-4 coffee", description: "coffee", amount: 4, date: "2026-10-19"},
+		{name: "plus is an income", line: "+2000 bonus", description: "bonus", amount: 2000, income: true, date: "2026-10-19"},
+		{name: "only the first amount", line: "12 2 coffees", description: "2 coffees", amount: 12, date: "2026-10-19"},
+		{name: "no plain decimal", line: "1,000 1e5 inf 3 things", description: "1,000 1e5 inf things", amount: 3, date: "2026-10-19"},
+		{name: "today", line: "today 5 bread", description: "bread", amount: 5, date: "2026-10-19"},
+		{name: "yesterday", line: "12.50 lunch yesterday", description: "lunch", amount: 12.5, date: "2026-10-18"},
+		{name: "days ago", line: "5 bread 3 days ago", description: "bread", amount: 5, date: "2026-10-16"},
+		{name: "one day ago", line: "5 bread 1 day ago", description: "bread", amount: 5, date: "2026-10-18"},
+		{name: "weeks ago", line: "5 bread 2 Weeks ago", description: "bread", amount: 5, date: "2026-10-05"},
+		{name: "iso date", line: "5 bread 2026-01-31", description: "bread", amount: 5, date: "2026-01-31"},
+		{name: "german date", line: "5 bread 31.1.2025", description: "bread", amount: 5, date: "2025-01-31"},
+		{name: "german date of this year", line: "5 bread 31.10.", description: "bread", amount: 5, date: "2026-10-31"},
+		{name: "category", line: "30 groceries @Food", description: "groceries", amount: 30, date: "2026-10-19", category: "Food"},
+		{name: "tags", line: "80 hotel #Vacation-Italy #trip", description: "hotel", amount: 80, date: "2026-10-19",
+			tags: []string{"vacation-italy", "trip"}},
+		{name: "lone markers are the description", line: "3 @ #", description: "@ #", amount: 3, date: "2026-10-19"},
+		{name: "everything", line: "#trip yesterday @Fun +20 found money", description: "found money", amount: 20, income: true,
+			date: "2026-10-18", category: "Fun", tags: []string{"trip"}},
+		{name: "no amount", line: "lunch yesterday", err: "no amount found"},
+		{name: "no description", line: "12.50 @Food yesterday", err: "no description found"},
+		{name: "empty", line: "  ", err: "no amount found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			quick, err := parseQuickAdd(test.line, now)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if quick.Description != test.description || quick.Amount != test.amount || quick.Income != test.income {
+				t.Errorf("got %q %.2f income %v, want %q %.2f income %v", quick.Description, quick.Amount, quick.Income,
+					test.description, test.amount, test.income)
+			}
+			if quick.Date() != test.date {
+				t.Errorf("got date %s, want %s", quick.Date(), test.date)
+			}
+			if quick.Category != test.category {
+				t.Errorf("got category %q, want %q", quick.Category, test.category)
+			}
+			if !reflect.DeepEqual(quick.Tags, test.tags) {
+				t.Errorf("got tags %v, want %v", quick.Tags, test.tags)
+			}
+		})
+	}
+}
+
+func TestParseQuickAddKeepsTheTimeOfDay(t *testing.T) {
+	now := time.Date(2026, 10, 19, 14, 30, 5, 0, time.Local)
+	quick, err := parseQuickAdd("5 bread 31.10.", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 31, 14, 30, 5, 0, time.Local); !quick.Timestamp.Equal(want) {
+		t.Errorf("got %v, want %v", quick.Timestamp, want)
+	}
+}
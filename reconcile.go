@@ -0,0 +1,127 @@
+/*
+This file holds the reconciliation of an account with a bank statement - ticking
+off the cleared transactions until they add up to the closing balance
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errLocked is returned when a reconciled transaction is changed without unlocking it first
+var errLocked = errors.New("the transaction is reconciled - unlock it first")
+
+// Reconciliation is a finished check of an account against a bank statement
+type Reconciliation struct {
+	ID      int
+	Account int
+	Date    string // the end date of the statement, 2006-01-02
+	Closing float64
+}
+
+// Key identifies a line of the register in a form, like "transaction-12" or "transfer-3"
+func (l RegisterLine) Key() string {
+	if l.TransferID != 0 {
+		return "transfer-" + strconv.Itoa(l.TransferID)
+	}
+	return "transaction-" + strconv.Itoa(l.TransactionID)
+}
+
+// Statement is the state of a reconciliation in progress: the lines up to the end date
+// of the statement that aren't reconciled yet, and the balance of the reconciled ones
+type Statement struct {
+	Date       string
+	Closing    float64
+	Reconciled float64 // opening balance and all reconciled lines
+	Lines      []RegisterLine
+}
+
+// Cleared returns the balance of the reconciled and the cleared lines
+func (s Statement) Cleared() float64 {
+	balance := s.Reconciled
+	for _, line := range s.Lines {
+		if line.Cleared {
+			balance += line.Amount
+		}
+	}
+	return balance
+}
+
+// Difference returns what is missing to the closing balance of the statement
+func (s Statement) Difference() float64 {
+	return math.Round((s.Closing-s.Cleared())*100) / 100
+}
+
+// parseStatement reads the end date and closing balance of a statement
+func parseStatement(date, closing string) (string, float64, error) {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", 0, fmt.Errorf("invalid statement date %q", date)
+	}
+	amount, err := strconv.ParseFloat(closing, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid closing balance %q", closing)
+	}
+	return date, amount, nil
+}
+
+// readStatement collects the lines of an account of a budget for a statement. Lines after its
+// end date are left for the next statement - unless they are cleared already.
+func readStatement(ctx context.Context, db *sql.DB, budget int, account Account, date string, closing float64) (Statement, error) {
+	lines, err := ReadRegister(ctx, db, budget, account.ID)
+	if err != nil {
+		return Statement{}, err
+	}
+	statement := Statement{Date: date, Closing: closing, Reconciled: account.Opening}
+	for _, line := range lines {
+		switch {
+		case line.Reconciliation != 0:
+			statement.Reconciled += line.Amount
+		case line.Date <= date || line.Cleared:
+			statement.Lines = append(statement.Lines, line)
+		}
+	}
+	return statement, nil
+}
+
+// reconcileAccount marks the lines with the given keys as cleared - and the others as not.
+// Finishing locks the cleared lines into a new reconciliation, which only works without
+// a difference to the closing balance.
+func reconcileAccount(ctx context.Context, db *sql.DB, budget int, account Account, date string, closing float64, keys []string, finish bool) (Statement, error) {
+	statement, err := readStatement(ctx, db, budget, account, date, closing)
+	if err != nil {
+		return statement, err
+	}
+	selected := make(map[string]bool)
+	for _, key := range keys {
+		selected[strings.TrimSpace(key)] = true
+	}
+	var cleared []RegisterLine
+	for i, line := range statement.Lines {
+		statement.Lines[i].Cleared = selected[line.Key()]
+		if statement.Lines[i].Cleared {
+			cleared = append(cleared, line)
+			delete(selected, line.Key())
+		}
+	}
+	for key := range selected {
+		return statement, fmt.Errorf("%s is not open on this account", key)
+	}
+	if !finish {
+		return statement, SetCleared(ctx, db, account.ID, cleared, sql.NullInt64{})
+	}
+	if difference := statement.Difference(); difference != 0 {
+		return statement, fmt.Errorf("there is a difference of %.2f to the closing balance", difference)
+	}
+	id, err := StoreReconciliation(ctx, db, Reconciliation{Account: account.ID, Date: date, Closing: closing})
+	if err != nil {
+		return statement, err
+	}
+	return statement, SetCleared(ctx, db, account.ID, cleared, ToNullInt64(id))
+}
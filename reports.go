@@ -0,0 +1,161 @@
+/*
+This file holds the comparison reports - a month against the month before and
+the same month a year ago, and the trend of every category over the last months
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The number of months in the trend, by default and at most
+const (
+	defaultReportMonths = 12
+	maxReportMonths     = 60
+)
+
+// Change is the change of an amount in percent. It is invalid if there is
+// nothing to compare with.
+type Change struct {
+	Percent float64
+	Valid   bool
+}
+
+// percentChange compares two amounts by their size, so spending more shows as an
+// increase for expenses (negative amounts) as well
+func percentChange(now, before float64) Change {
+	if math.Abs(before) < 0.005 {
+		return Change{}
+	}
+	return Change{Percent: (math.Abs(now) - math.Abs(before)) / math.Abs(before) * 100, Valid: true}
+}
+
+// String returns the change for display, like "+12.5%"
+func (c Change) String() string {
+	if !c.Valid {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", c.Percent)
+}
+
+// MarshalJSON writes the change as number, or null without a comparison
+func (c Change) MarshalJSON() ([]byte, error) {
+	if !c.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(math.Round(c.Percent*10) / 10)
+}
+
+// Comparison compares a category's month with the month before and the same month last year
+type Comparison struct {
+	Category      string  `json:"category"`
+	Current       float64 `json:"current"`
+	PreviousMonth float64 `json:"previous_month"`
+	LastYear      float64 `json:"last_year"`
+	MonthChange   Change  `json:"month_change"`
+	YearChange    Change  `json:"year_change"`
+}
+
+// Trend holds the amounts of a category per month, oldest first
+type Trend struct {
+	Category string    `json:"category"`
+	Amounts  []float64 `json:"amounts"`
+	Average  float64   `json:"average"`
+	// The last month against the average of the months before
+	Change Change `json:"change"`
+}
+
+// Report is the comparison of a month and the trend of the months up to it
+type Report struct {
+	Month       string       `json:"month"`
+	Months      []string     `json:"months"`
+	Comparisons []Comparison `json:"comparisons"`
+	Total       Comparison   `json:"total"`
+	Trends      []Trend      `json:"trends"`
+}
+
+// parseReportMonth reads a month like "2016-10" - the current month if empty
+func parseReportMonth(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	month, err := time.Parse("2006-01", value)
+	if err != nil {
+		return month, fmt.Errorf("invalid month %q", value)
+	}
+	return month, nil
+}
+
+// parseReportMonths reads the number of months of the trend
+func parseReportMonths(value string) (int, error) {
+	if value == "" {
+		return defaultReportMonths, nil
+	}
+	months, err := strconv.Atoi(value)
+	if err != nil || months < 2 || months > maxReportMonths {
+		return 0, fmt.Errorf("months has to be between 2 and %d", maxReportMonths)
+	}
+	return months, nil
+}
+
+// buildReport compares the month (the first day of it) with the month before and
+// a year before, and follows every top-level category over the last months
+func buildReport(ctx context.Context, db *sql.DB, budget int, month time.Time, months int) (Report, error) {
+	report := Report{Month: month.Format("2006-01"), Comparisons: []Comparison{}, Trends: []Trend{}}
+	for i := months - 1; i >= 0; i-- {
+		report.Months = append(report.Months, month.AddDate(0, -i, 0).Format("2006-01"))
+	}
+	// The same month last year might lie before the trend
+	first := month.AddDate(0, -(months - 1), 0)
+	if lastYear := month.AddDate(-1, 0, 0); lastYear.Before(first) {
+		first = lastYear
+	}
+	entries, err := SumMonthlyByRoot(ctx, db, budget, first.Format("2006-01-02"), month.AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		return Report{}, err
+	}
+	sums := make(map[string]map[string]float64)
+	totals := make(map[string]float64)
+	for _, item := range entries {
+		if sums[item.Mapping] == nil {
+			sums[item.Mapping] = make(map[string]float64)
+		}
+		sums[item.Mapping][item.Date] += item.Amount
+		totals[item.Date] += item.Amount
+	}
+	var categories []string
+	for category := range sums {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	previous, lastYear := month.AddDate(0, -1, 0).Format("2006-01"), month.AddDate(-1, 0, 0).Format("2006-01")
+	compare := func(category string, amounts map[string]float64) Comparison {
+		c := Comparison{Category: category, Current: amounts[report.Month], PreviousMonth: amounts[previous], LastYear: amounts[lastYear]}
+		c.MonthChange = percentChange(c.Current, c.PreviousMonth)
+		c.YearChange = percentChange(c.Current, c.LastYear)
+		return c
+	}
+	for _, category := range categories {
+		report.Comparisons = append(report.Comparisons, compare(category, sums[category]))
+		trend := Trend{Category: category}
+		for _, key := range report.Months {
+			trend.Amounts = append(trend.Amounts, sums[category][key])
+		}
+		var before float64
+		for _, amount := range trend.Amounts[:len(trend.Amounts)-1] {
+			before += amount
+		}
+		trend.Average = (before + trend.Amounts[len(trend.Amounts)-1]) / float64(months)
+		trend.Change = percentChange(trend.Amounts[len(trend.Amounts)-1], before/float64(months-1))
+		report.Trends = append(report.Trends, trend)
+	}
+	report.Total = compare("Total", totals)
+	return report, nil
+}
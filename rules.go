@@ -0,0 +1,177 @@
+/*
+This file holds the categorisation rules, which map descriptions to
+categories by contained text, prefix, regular expression or amount range
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// The kinds of rules - how the pattern is matched against the description
+var ruleKinds = []string{"contains", "prefix", "regex", "amount"}
+
+// Rule basic struct
+// A rule categorizes every transaction whose description matches the pattern
+// and whose amount (without sign) lies within Min and Max, if those are set.
+// Rules with a higher priority are checked first.
+type Rule struct {
+	ID       int
+	Priority int
+	Kind     string
+	Pattern  string
+	Min      sql.NullFloat64
+	Max      sql.NullFloat64
+	Mapping  string
+	// The compiled pattern of a regex rule, set when the rules are read (see compile)
+	regex *regexp.Regexp
+}
+
+// validate checks a rule before it is stored
+func (rule Rule) validate() error {
+	if strings.TrimSpace(rule.Mapping) == "" {
+		return errors.New("a rule needs a category")
+	}
+	switch rule.Kind {
+	case "contains", "prefix":
+		if rule.Pattern == "" {
+			return errors.New("a rule needs a text to look for")
+		}
+	case "regex":
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return errors.New("invalid regular expression: " + err.Error())
+		}
+	case "amount":
+		if !rule.Min.Valid && !rule.Max.Valid {
+			return errors.New("an amount rule needs a minimum or a maximum")
+		}
+	default:
+		return errors.New("unknown kind of rule: " + rule.Kind)
+	}
+	return nil
+}
+
+// compile compiles the pattern of a regex rule once, instead of for every transaction.
+// A pattern that doesn't compile leaves the rule without a regex, it matches nothing then.
+func (rule *Rule) compile() {
+	if rule.Kind == "regex" {
+		rule.regex, _ = regexp.Compile(rule.Pattern)
+	}
+}
+
+// matches checks if the rule applies to a transaction.
+// contains and prefix ignore the case.
+func (rule Rule) matches(item Transaction) bool {
+	amount := item.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+	if rule.Min.Valid && amount < rule.Min.Float64 {
+		return false
+	}
+	if rule.Max.Valid && amount > rule.Max.Float64 {
+		return false
+	}
+	description := strings.ToLower(item.Description)
+	switch rule.Kind {
+	case "contains":
+		return strings.Contains(description, strings.ToLower(rule.Pattern))
+	case "prefix":
+		return strings.HasPrefix(description, strings.ToLower(rule.Pattern))
+	case "regex":
+		return rule.regex != nil && rule.regex.MatchString(item.Description)
+	case "amount":
+		return true
+	}
+	return false
+}
+
+// firstMatch returns the rule with the highest priority that matches the transaction.
+// The rules have to be ordered like ReadRules returns them.
+func firstMatch(rules []Rule, item Transaction) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.matches(item) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// categorize applies the rules of a budget to a newly stored transaction.
+// Descriptions that already have a category are left alone.
+func categorize(ctx context.Context, db *sql.DB, budget int, user User, item Transaction) error {
+	var mapping sql.NullString
+	row := db.QueryRowContext(ctx, "SELECT mapping FROM mappings WHERE budget = ? AND description = ?", budget, item.Description)
+	if err := row.Scan(&mapping); err == nil && mapping.String != "" {
+		return nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	rules, err := ReadRules(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	if rule, ok := firstMatch(rules, item); ok {
+		return setMapping(ctx, db, budget, user, item.Description, rule.Mapping)
+	}
+	return nil
+}
+
+// previewRules returns the existing transactions each of the rules applies to, by rule ID.
+// A transaction only counts for the first rule matching it.
+func previewRules(ctx context.Context, db *sql.DB, budget int, rules []Rule) (map[int][]Transaction, error) {
+	transactions, err := readAllTransactions(ctx, db, budget)
+	if err != nil {
+		return nil, err
+	}
+	preview := make(map[int][]Transaction)
+	for _, item := range transactions {
+		if rule, ok := firstMatch(rules, item); ok {
+			preview[rule.ID] = append(preview[rule.ID], item)
+		}
+	}
+	return preview, nil
+}
+
+// reapplyRules categorizes all existing transactions by the rules - overwriting
+// categories set by hand. If the transactions of a description match different
+// rules, the newest transaction decides. The changes are logged as made by the user.
+// Returns the number of changed descriptions.
+func reapplyRules(ctx context.Context, db *sql.DB, budget int, user User) (int, error) {
+	rules, err := ReadRules(ctx, db, budget)
+	if err != nil {
+		return 0, err
+	}
+	// readAllTransactions returns the oldest first, so later ones overwrite
+	transactions, err := readAllTransactions(ctx, db, budget)
+	if err != nil {
+		return 0, err
+	}
+	cats, err := getCategories(ctx, db, budget)
+	if err != nil {
+		return 0, err
+	}
+	mappings := make(map[string]string)
+	for _, item := range transactions {
+		if rule, ok := firstMatch(rules, item); ok {
+			mappings[item.Description] = rule.Mapping
+		}
+	}
+	current := make(map[string]Category)
+	for _, cat := range cats {
+		current[cat.Description] = cat
+	}
+	var changed []Category
+	for description, mapping := range mappings {
+		cat := current[description]
+		if cat.Mapping.String == mapping {
+			continue
+		}
+		changed = append(changed, Category{ID: ToNullInt64(int(FromNullInt64(cat.ID))), Description: description, Mapping: ToNullString(mapping)})
+	}
+	return len(changed), UpdateCats(ctx, db, budget, user, changed)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB sets up an empty database in a temporary directory as db
+func openTestDB(t *testing.T) context.Context {
+	ctx := context.Background()
+	db = initDB(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	CreateTable(ctx, db)
+	return ctx
+}
+
+func TestRuleMatches(t *testing.T) {
+	min, max := sql.NullFloat64{Float64: 10, Valid: true}, sql.NullFloat64{Float64: 50, Valid: true}
+	tests := []struct {
+		name string
+		rule Rule
+		item Transaction
+		want bool
+	}{
+		{name: "contains", rule: Rule{Kind: "contains", Pattern: "coop"}, item: Transaction{Description: "Coop Pronto 123"}, want: true},
+		{name: "contains not", rule: Rule{Kind: "contains", Pattern: "migros"}, item: Transaction{Description: "Coop Pronto 123"}},
+		{name: "prefix", rule: Rule{Kind: "prefix", Pattern: "SBB"}, item: Transaction{Description: "sbb mobile"}, want: true},
+		{name: "prefix in the middle", rule: Rule{Kind: "prefix", Pattern: "mobile"}, item: Transaction{Description: "sbb mobile"}},
+		{name: "regex", rule: Rule{Kind: "regex", Pattern: `^Coop( Pronto)? \d+$`}, item: Transaction{Description: "Coop Pronto 123"}, want: true},
+		{name: "regex keeps the case", rule: Rule{Kind: "regex", Pattern: `^coop`}, item: Transaction{Description: "Coop Pronto 123"}},
+		{name: "regex ignoring the case", rule: Rule{Kind: "regex", Pattern: `(?i)^coop`}, item: Transaction{Description: "Coop Pronto 123"}, want: true},
+		{name: "invalid regex", rule: Rule{Kind: "regex", Pattern: `Coop(`}, item: Transaction{Description: "Coop("}},
+		{name: "amount within", rule: Rule{Kind: "amount", Min: min, Max: max}, item: Transaction{Description: "x", Amount: -10}, want: true},
+		{name: "amount at the maximum", rule: Rule{Kind: "amount", Min: min, Max: max}, item: Transaction{Description: "x", Amount: 50}, want: true},
+		{name: "amount below", rule: Rule{Kind: "amount", Min: min, Max: max}, item: Transaction{Description: "x", Amount: -9.99}},
+		{name: "amount above", rule: Rule{Kind: "amount", Min: min}, item: Transaction{Description: "x", Amount: 5}},
+		{name: "amount without a minimum", rule: Rule{Kind: "amount", Max: max}, item: Transaction{Description: "x", Amount: 0.5}, want: true},
+		{name: "contains within the range", rule: Rule{Kind: "contains", Pattern: "coop", Min: min, Max: max}, item: Transaction{Description: "Coop", Amount: -20}, want: true},
+		{name: "contains out of the range", rule: Rule{Kind: "contains", Pattern: "coop", Min: min, Max: max}, item: Transaction{Description: "Coop", Amount: -60}},
+		{name: "unknown kind", rule: Rule{Kind: "suffix", Pattern: "123"}, item: Transaction{Description: "Coop Pronto 123"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.compile()
+			if got := test.rule.matches(test.item); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{name: "contains", rule: Rule{Kind: "contains", Pattern: "coop", Mapping: "Food"}},
+		{name: "regex", rule: Rule{Kind: "regex", Pattern: `^Coop \d+$`, Mapping: "Food"}},
+		{name: "amount", rule: Rule{Kind: "amount", Max: sql.NullFloat64{Float64: 5, Valid: true}, Mapping: "Coffee"}},
+		{name: "no category", rule: Rule{Kind: "contains", Pattern: "coop", Mapping: " "}, err: "a rule needs a category"},
+		{name: "no text", rule: Rule{Kind: "prefix", Mapping: "Food"}, err: "a rule needs a text to look for"},
+		{name: "invalid regex", rule: Rule{Kind: "regex", Pattern: "Coop(", Mapping: "Food"}, err: "invalid regular expression"},
+		{name: "amount without a range", rule: Rule{Kind: "amount", Mapping: "Food"}, err: "an amount rule needs a minimum or a maximum"},
+		{name: "unknown kind", rule: Rule{Kind: "suffix", Pattern: "x", Mapping: "Food"}, err: "unknown kind of rule: suffix"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.validate()
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	ctx := openTestDB(t)
+	for _, rule := range []Rule{
+		{Priority: 0, Kind: "contains", Pattern: "coop", Mapping: "Groceries"},
+		{Priority: 10, Kind: "prefix", Pattern: "coop pronto", Mapping: "Snacks"},
+		{Priority: 0, Kind: "amount", Min: sql.NullFloat64{Float64: 100, Valid: true}, Mapping: "Big"},
+		{Priority: 0, Kind: "contains", Pattern: "pronto", Mapping: "Later"},
+		// Stored without validation, like rules from before regex rules were checked
+		{Priority: 20, Kind: "regex", Pattern: "Coop(", Mapping: "Broken"},
+		{Priority: 5, Kind: "regex", Pattern: `^Coop \d+$`, Mapping: "Shop"},
+	} {
+		if err := StoreRule(ctx, db, 1, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := StoreRule(ctx, db, 2, Rule{Priority: 99, Kind: "contains", Pattern: "coop", Mapping: "Other budget"}); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadRules(ctx, db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		description string
+		amount      float64
+		want        string
+	}{
+		{description: "Coop Pronto 12", amount: -5, want: "Snacks"},
+		{description: "Coop 12", amount: -5, want: "Shop"},
+		{description: "Coop City", amount: -5, want: "Groceries"},
+		{description: "Coop City", amount: -500, want: "Groceries"},
+		{description: "Pronto", amount: -500, want: "Big"},
+		{description: "Pronto", amount: -5, want: "Later"},
+		{description: "Coop(", amount: -5, want: "Groceries"},
+		{description: "Migros", amount: -5},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rule, ok := firstMatch(rules, Transaction{Description: test.description, Amount: test.amount})
+			if ok != (test.want != "") || rule.Mapping != test.want {
+				t.Errorf("got %q (%v), want %q", rule.Mapping, ok, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/*
+This file holds the protection against cross-site requests and the security headers
+of all responses. Every form sends a CSRF token along, which has to match the one in
+the CSRF cookie - another site can make the browser post a form, but it can't read
+the cookie to put the token into it.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// The names of the CSRF cookie, of the form field and of the header (for scripts) with the token
+const (
+	csrfCookie = "gofinance_csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfKey holds the CSRF token of a request in its context, for the forms of the pages
+const csrfKey contextKey = "csrf"
+
+// contentSecurityPolicy allows the scripts and styles of the pages and their CDNs, but no
+// framing of the pages and no forms to other sites. The scripts of the pages are in static/,
+// so no inline script can run - the pages hand their data over as JSON or data attributes.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' https://ajax.googleapis.com https://maxcdn.bootstrapcdn.com https://cdn.datatables.net https://cdnjs.cloudflare.com; " +
+	"style-src 'self' 'unsafe-inline' https://maxcdn.bootstrapcdn.com https://cdn.datatables.net; " +
+	"font-src 'self' https://maxcdn.bootstrapcdn.com; img-src 'self' data: https://cdn.datatables.net; " +
+	"frame-ancestors 'none'; form-action 'self'; base-uri 'self'"
+
+// secureCookie tells whether cookies should only travel over HTTPS - with TLS,
+// or behind an HTTPS reverse proxy (the -secure-cookies flag)
+func secureCookie(r *http.Request) bool {
+	return r.TLS != nil || *secureCookies
+}
+
+// csrfToken returns the CSRF token of a request's cookie - or sets a new one. The cookie
+// isn't HttpOnly, so scripts using the API from a browser can send it in the header.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 43 {
+		return cookie.Value, nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: token, Path: "/",
+		Secure: secureCookie(r), SameSite: http.SameSiteStrictMode})
+	return token, nil
+}
+
+// fromBrowser tells whether a request comes from a browser - browsers send the Origin
+// or Sec-Fetch-Site header with every POST, scripts using the API don't
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
+
+// sentToken returns the CSRF token sent with a request - from the header, or from the form.
+// File uploads send it in the URL, so the upload isn't read before its size is checked.
+func sentToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.URL.Query().Get(csrfField)
+	}
+	return r.PostFormValue(csrfField)
+}
+
+// requireCSRF lets only requests with the right CSRF token change anything. API scripts
+// outside a browser don't need one, they can't be tricked into sending a request.
+func requireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := csrfToken(w, r)
+		if err != nil {
+			panic(err)
+		}
+		safe := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		if !safe && (!api || fromBrowser(r)) && subtle.ConstantTimeCompare([]byte(sentToken(r)), []byte(token)) != 1 {
+			if api {
+				writeJSONError(w, http.StatusForbidden, "missing or wrong CSRF token")
+			} else {
+				http.Error(w, "The form has expired - go back, reload the page and try again", http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey, token)))
+	})
+}
+
+// parsePage parses the templates of a page. Its forms get the request's CSRF token with
+// {{template "csrf"}} (see header.html) - uploads with {{csrfToken}} in the URL.
+func parsePage(r *http.Request, files ...string) (*template.Template, error) {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return template.New(filepath.Base(files[0])).Funcs(template.FuncMap{
+		"csrfToken": func() string { return token },
+	}).ParseFiles(files...)
+}
+
+// secureHeaders sets the security headers of all responses
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Referrer-Policy", "same-origin")
+		if r.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
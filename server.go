@@ -0,0 +1,129 @@
+/*
+This file holds the running of the web server - timeouts and body size limits against
+slow or huge requests, health checks for process supervisors, and the graceful shutdown
+on SIGINT or SIGTERM, which lets running requests finish before the database is closed
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How long a client may take to send the request headers
+const readHeaderTimeout = 10 * time.Second
+
+// shuttingDown is set once the server stops taking requests, so it isn't ready anymore
+var shuttingDown atomic.Bool
+
+// newServer returns a web server with the configured timeouts
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout: *readTimeout, WriteTimeout: *writeTimeout, IdleTimeout: *idleTimeout}
+}
+
+// limitBody stops reading request bodies larger than -max-body-size. Uploads have their
+// own, larger limit (see uploadAttachment).
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/confirm/attach/") {
+			if r.ContentLength > *maxBodySize {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, *maxBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthChecks answers the health checks of process supervisors, without signing in:
+// /healthz while the process runs, /readyz while it takes requests and the database works
+func healthChecks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			fmt.Fprintln(w, "ok")
+		case "/readyz":
+			if shuttingDown.Load() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			if err := db.PingContext(r.Context()); err != nil {
+				http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serverError answers a request whose work failed with a 500 - unless the client went
+// away, then there is nobody to answer
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// followClient stops the work on pages when their client goes away: the database calls
+// get the request's context, which is canceled then, and the pages end quietly with
+// serverError. Changes aren't canceled, so a client going away never leaves one half done.
+func followClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r.WithContext(context.WithoutCancel(r.Context())))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runServers serves until a server fails or the process gets SIGINT or SIGTERM. Then the
+// servers stop taking connections and wait up to -shutdown-timeout for the running requests.
+func runServers(servers ...*http.Server) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				errs <- server.ListenAndServeTLS("", "")
+			} else {
+				errs <- server.ListenAndServe()
+			}
+		}(server)
+	}
+	var err error
+	select {
+	case sig := <-stop:
+		log.Printf("Got %v, finishing the running requests", sig)
+	case err = <-errs:
+	}
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+/*
+This file holds the shared expenses - a transaction paid by one member of a budget
+and divided among several, who owes whom and the payments to settle up
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shareModes are the ways to divide a transaction, in the order they are offered
+var shareModes = []string{"equal", "percent", "exact"}
+
+// Share is the part of a shared transaction a member bears. The amount is always
+// positive, like the amount of a split part.
+type Share struct {
+	User
+	Amount float64
+}
+
+// Balance is what a member is owed (positive) or owes (negative)
+type Balance struct {
+	User
+	Amount float64
+}
+
+// Payment is money one member gives to another to settle up
+type Payment struct {
+	Date   string
+	From   User
+	To     User
+	Amount float64
+}
+
+// toCents rounds an amount to whole cents
+func toCents(amount float64) int64 {
+	return int64(math.Round(math.Abs(amount) * 100))
+}
+
+// parseShares divides a total among the members given by name. Equal shares ignore the
+// values, percentages have to add up to 100 and exact amounts to the total. Cents that
+// don't divide evenly go to the first members.
+func parseShares(mode string, total float64, names, values []string) ([]Share, error) {
+	if len(names) != len(values) {
+		return nil, errors.New("malformed share form")
+	}
+	if len(names) == 0 {
+		return nil, errors.New("pick the members who share the transaction")
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if seen[key] {
+			return nil, fmt.Errorf("%s is there twice", name)
+		}
+		seen[key] = true
+	}
+	cents := toCents(total)
+	parts := make([]int64, len(names))
+	switch mode {
+	case "equal":
+		for i := range parts {
+			parts[i] = cents / int64(len(parts))
+			if int64(i) < cents%int64(len(parts)) {
+				parts[i]++
+			}
+		}
+	case "percent", "exact":
+		var sum float64
+		numbers := make([]float64, len(values))
+		for i, value := range values {
+			number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || number < 0 {
+				return nil, fmt.Errorf("invalid %s %q for %s", mode, value, names[i])
+			}
+			numbers[i] = number
+			sum += number
+		}
+		if mode == "percent" {
+			if math.Abs(sum-100) >= 0.005 {
+				return nil, fmt.Errorf("the percentages add up to %.2f instead of 100", sum)
+			}
+			rest := cents
+			for i, number := range numbers {
+				parts[i] = int64(math.Round(float64(cents) * number / 100))
+				rest -= parts[i]
+			}
+			parts[0] += rest
+		} else {
+			if diff := math.Abs(total) - sum; math.Abs(diff) >= 0.005 {
+				return nil, fmt.Errorf("the shares add up to %.2f instead of %.2f (%+.2f)", sum, math.Abs(total), diff)
+			}
+			for i, number := range numbers {
+				parts[i] = toCents(number)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q, use equal, percent or exact", mode)
+	}
+	var shares []Share
+	for i, name := range names {
+		shares = append(shares, Share{User: User{Name: strings.TrimSpace(name)}, Amount: float64(parts[i]) / 100})
+	}
+	return shares, nil
+}
+
+// checkShares checks that the shares add up to the total of the transaction.
+// No shares at all are fine - the transaction isn't shared then.
+func checkShares(total float64, shares []Share) error {
+	if len(shares) == 0 {
+		return nil
+	}
+	var sum float64
+	for _, share := range shares {
+		sum += share.Amount
+	}
+	if diff := math.Abs(total) - sum; math.Abs(diff) >= 0.005 {
+		return fmt.Errorf("the shares add up to %.2f instead of %.2f (%+.2f)", sum, math.Abs(total), diff)
+	}
+	return nil
+}
+
+// findMember returns the member of a budget with a name (in any case) - an ID of 0 if there is none
+func findMember(members []Member, name string) User {
+	for _, member := range members {
+		if strings.EqualFold(member.Name, strings.TrimSpace(name)) {
+			return member.User
+		}
+	}
+	return User{}
+}
+
+// shareTransaction sets who paid a transaction and divides it among members, all given by
+// name. Without a payer the transaction belongs to the whole budget again, with a payer but
+// no shares only to the payer.
+func shareTransaction(ctx context.Context, db *sql.DB, budget int, user User, id int, payer string, shares []Share) error {
+	item, err := getSingle(ctx, db, budget, id, "transactions")
+	if err != nil {
+		return err
+	}
+	members, err := ReadMembers(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	var paidBy User
+	if strings.TrimSpace(payer) != "" {
+		if paidBy = findMember(members, payer); paidBy.ID == 0 {
+			return fmt.Errorf("%s isn't a member of the budget", payer)
+		}
+	} else if len(shares) > 0 {
+		return errors.New("a shared transaction needs the member who paid it")
+	}
+	for i, share := range shares {
+		user := findMember(members, share.Name)
+		if user.ID == 0 {
+			return fmt.Errorf("%s isn't a member of the budget", share.Name)
+		}
+		shares[i].User = user
+	}
+	if err := checkShares(item.Amount, shares); err != nil {
+		return err
+	}
+	return SetShares(ctx, db, budget, user, id, paidBy.ID, shares)
+}
+
+// settleUp returns the payments that even out the balances: the member who owes the most
+// pays the one who is owed the most, until nobody owes anything. That takes at most one
+// payment less than there are members with a balance.
+func settleUp(balances []Balance) []Payment {
+	var owing, owed []Balance
+	for _, balance := range balances {
+		cents := int64(math.Round(balance.Amount * 100))
+		switch {
+		case cents < 0:
+			owing = append(owing, Balance{User: balance.User, Amount: float64(-cents)})
+		case cents > 0:
+			owed = append(owed, Balance{User: balance.User, Amount: float64(cents)})
+		}
+	}
+	byAmount := func(list []Balance) {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Amount > list[j].Amount })
+	}
+	var payments []Payment
+	for len(owing) > 0 && len(owed) > 0 {
+		byAmount(owing)
+		byAmount(owed)
+		amount := math.Min(owing[0].Amount, owed[0].Amount)
+		payments = append(payments, Payment{From: owing[0].User, To: owed[0].User, Amount: amount / 100})
+		owing[0].Amount -= amount
+		owed[0].Amount -= amount
+		if owing[0].Amount == 0 {
+			owing = owing[1:]
+		}
+		if owed[0].Amount == 0 {
+			owed = owed[1:]
+		}
+	}
+	return payments
+}
+
+// recordSettlement saves a payment between two members, given by name
+func recordSettlement(ctx context.Context, db *sql.DB, budget int, from, to, amount string) error {
+	members, err := ReadMembers(ctx, db, budget)
+	if err != nil {
+		return err
+	}
+	item := Payment{From: findMember(members, from), To: findMember(members, to)}
+	for i, user := range []User{item.From, item.To} {
+		if user.ID == 0 {
+			return fmt.Errorf("%s isn't a member of the budget", []string{from, to}[i])
+		}
+	}
+	if item.From.ID == item.To.ID {
+		return errors.New("a payment needs two different members")
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+	if err != nil || value <= 0 {
+		return fmt.Errorf("invalid amount %q", amount)
+	}
+	item.Amount = value
+	return StoreSettlement(ctx, db, budget, item)
+}
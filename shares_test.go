@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// amounts returns the names and amounts of shares, to compare them in the tests
+func amounts(shares []Share) map[string]float64 {
+	result := make(map[string]float64)
+	for _, share := range shares {
+		result[share.Name] = share.Amount
+	}
+	return result
+}
+
+func TestParseShares(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		total  float64
+		names  []string
+		values []string
+		want   map[string]float64
+		err    string
+	}{
+		{name: "equal", mode: "equal", total: 30, names: []string{"anna", "ben"}, values: []string{"", ""},
+			want: map[string]float64{"anna": 15, "ben": 15}},
+		{name: "equal remainder goes to the first", mode: "equal", total: 10, names: []string{"anna", "ben", "cleo"}, values: []string{"", "", ""},
+			want: map[string]float64{"anna": 3.34, "ben": 3.33, "cleo": 3.33}},
+		{name: "equal of an expense", mode: "equal", total: -10, names: []string{"anna", "ben"}, values: []string{"", ""},
+			want: map[string]float64{"anna": 5, "ben": 5}},
+		{name: "percent", mode: "percent", total: 200, names: []string{"anna", "ben"}, values: []string{"60", "40"},
+			want: map[string]float64{"anna": 120, "ben": 80}},
+		{name: "percent remainder goes to the first", mode: "percent", total: 10, names: []string{"anna", "ben", "cleo"}, values: []string{"33.33", "33.33", "33.34"},
+			want: map[string]float64{"anna": 3.34, "ben": 3.33, "cleo": 3.33}},
+		{name: "percent rounding up is taken from the first", mode: "percent", total: 0.01, names: []string{"anna", "ben"}, values: []string{"50", "50"},
+			want: map[string]float64{"anna": 0, "ben": 0.01}},
+		{name: "percent not adding up", mode: "percent", total: 10, names: []string{"anna", "ben"}, values: []string{"60", "30"},
+			err: "the percentages add up to 90.00 instead of 100"},
+		{name: "exact", mode: "exact", total: -10, names: []string{"anna", "ben"}, values: []string{"2.50", "7.50"},
+			want: map[string]float64{"anna": 2.5, "ben": 7.5}},
+		{name: "exact too little", mode: "exact", total: 10, names: []string{"anna", "ben"}, values: []string{"4", "5"},
+			err: "the shares add up to 9.00 instead of 10.00 (+1.00)"},
+		{name: "exact too much", mode: "exact", total: 10, names: []string{"anna", "ben"}, values: []string{"4", "6.50"},
+			err: "the shares add up to 10.50 instead of 10.00 (-0.50)"},
+		{name: "negative value", mode: "exact", total: 10, names: []string{"anna", "ben"}, values: []string{"15", "-5"},
+			err: `invalid exact "-5" for ben`},
+		{name: "invalid value", mode: "percent", total: 10, names: []string{"anna"}, values: []string{"all"},
+			err: `invalid percent "all" for anna`},
+		{name: "member twice", mode: "equal", total: 10, names: []string{"anna", " ANNA"}, values: []string{"", ""},
+			err: " ANNA is there twice"},
+		{name: "no members", mode: "equal", total: 10,
+			err: "pick the members who share the transaction"},
+		{name: "unknown mode", mode: "halves", total: 10, names: []string{"anna"}, values: []string{""},
+			err: `unknown mode "halves"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shares, err := parseShares(test.mode, test.total, test.names, test.values)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := amounts(shares); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSettleUp(t *testing.T) {
+	anna, ben, cleo, dan := User{ID: 1, Name: "anna"}, User{ID: 2, Name: "ben"}, User{ID: 3, Name: "cleo"}, User{ID: 4, Name: "dan"}
+	tests := []struct {
+		name     string
+		balances []Balance
+		want     []Payment
+	}{
+		{name: "nobody owes anything", balances: []Balance{{anna, 0}, {ben, 0}}},
+		{name: "less than a cent", balances: []Balance{{anna, 0.004}, {ben, -0.004}}},
+		{name: "two members", balances: []Balance{{anna, 12.5}, {ben, -12.5}},
+			want: []Payment{{From: ben, To: anna, Amount: 12.5}}},
+		{name: "one owed by two", balances: []Balance{{anna, 30}, {ben, -10}, {cleo, -20}},
+			want: []Payment{{From: cleo, To: anna, Amount: 20}, {From: ben, To: anna, Amount: 10}}},
+		{name: "the largest debts first", balances: []Balance{{anna, 50}, {ben, 10}, {cleo, -35}, {dan, -25}},
+			want: []Payment{{From: cleo, To: anna, Amount: 35}, {From: dan, To: anna, Amount: 15}, {From: dan, To: ben, Amount: 10}}},
+		{name: "rounded to cents", balances: []Balance{{anna, 10.004}, {ben, -3.333}, {cleo, -6.667}},
+			want: []Payment{{From: cleo, To: anna, Amount: 6.67}, {From: ben, To: anna, Amount: 3.33}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := settleUp(test.balances); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
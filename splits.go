@@ -0,0 +1,75 @@
+/*
+This file holds the split transactions - a single transaction (like a supermarket
+receipt) divided into parts with their own amount and category
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Split is a part of a split transaction. The amount is always positive,
+// the part is an expense or income like its transaction.
+type Split struct {
+	ID      int
+	Amount  float64
+	Mapping string
+}
+
+// parseSplits builds the parts out of the parallel amount and category values of the
+// split form. Rows without an amount are skipped.
+func parseSplits(amounts, mappings []string) ([]Split, error) {
+	if len(amounts) != len(mappings) {
+		return nil, errors.New("malformed split form")
+	}
+	var splits []Split
+	for i := range amounts {
+		value := strings.TrimSpace(amounts[i])
+		if value == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid amount %q", value)
+		}
+		splits = append(splits, Split{Amount: amount, Mapping: strings.TrimSpace(mappings[i])})
+	}
+	return splits, nil
+}
+
+// checkSplits checks that the parts add up to the total of the transaction.
+// No parts at all are fine - the transaction isn't split then.
+func checkSplits(total float64, splits []Split) error {
+	if len(splits) == 0 {
+		return nil
+	}
+	if len(splits) == 1 {
+		return errors.New("a split needs at least two parts")
+	}
+	var sum float64
+	for _, split := range splits {
+		sum += split.Amount
+	}
+	if diff := math.Abs(total) - sum; math.Abs(diff) >= 0.005 {
+		return fmt.Errorf("the parts add up to %.2f instead of %.2f (%+.2f)", sum, math.Abs(total), diff)
+	}
+	return nil
+}
+
+// splitTransaction divides a transaction into parts, or removes the split without parts
+func splitTransaction(ctx context.Context, db *sql.DB, budget int, user User, id int, splits []Split) error {
+	item, err := getSingle(ctx, db, budget, id, "transactions")
+	if err != nil {
+		return err
+	}
+	if err := checkSplits(item.Amount, splits); err != nil {
+		return err
+	}
+	return SetSplits(ctx, db, budget, user, id, splits)
+}
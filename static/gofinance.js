@@ -0,0 +1,11 @@
+// The behaviour shared by all pages: sortable tables, selects that submit their
+// form and buttons that ask before deleting
+$(function() {
+  $('.datatable').DataTable();
+  $('[data-autosubmit]').change(function() {
+    this.form.submit();
+  });
+  $('[data-confirm]').click(function() {
+    return confirm($(this).data('confirm'));
+  });
+});
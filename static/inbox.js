@@ -0,0 +1,44 @@
+// The keyboard shortcuts and row selection of the inbox
+$(function() {
+  var rows = $(".inbox-row");
+  var current = 0;
+  function focusRow(i) {
+    if (rows.length == 0) { return; }
+    current = Math.max(0, Math.min(rows.length - 1, i));
+    rows.removeClass("info");
+    $(rows[current]).addClass("info");
+    rows[current].scrollIntoView({block: "nearest"});
+  }
+  function toggle(row, state) {
+    var box = $(row).find("input[type=checkbox]");
+    box.prop("checked", state === undefined ? !box.prop("checked") : state);
+  }
+  focusRow(0);
+  rows.click(function(e) {
+    focusRow(rows.index(this));
+    if (!$(e.target).is("input, a")) { toggle(this); }
+  });
+  $("#selectall").change(function() { rows.each(function() { toggle(this, $("#selectall").prop("checked")); }); });
+  $(".suggestion").click(function(e) {
+    e.preventDefault();
+    toggle($(this).closest("tr"), true);
+    $("#category").val($(this).data("mapping")).focus();
+  });
+  $(document).keydown(function(e) {
+    if ($(e.target).is("input[type=text]")) { return; }
+    switch (e.key) {
+      case "j": focusRow(current + 1); break;
+      case "k": focusRow(current - 1); break;
+      case "x": toggle(rows[current]); break;
+      case "s":
+        var description = $(rows[current]).data("description");
+        rows.filter(function() { return $(this).data("description") == description; }).each(function() { toggle(this, true); });
+        break;
+      case "a": rows.each(function() { toggle(this, true); }); break;
+      case "c": $("#category").focus(); break;
+      case "Enter": $("#inbox").submit(); break;
+      default: return;
+    }
+    e.preventDefault();
+  });
+});
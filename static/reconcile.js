@@ -0,0 +1,18 @@
+// The difference between the cleared and the closing balance, updated with every change
+$(function() {
+  var reconciled = parseFloat($("#reconcile").data("reconciled"))
+  function updateDifference() {
+    var cleared = reconciled
+    $("input[name=cleared]:checked").each(function () {
+      cleared += parseFloat($(this).data("amount"))
+    })
+    var closing = parseFloat($("#balance").val()) || 0
+    var difference = Math.round((closing - cleared) * 100) / 100
+    $("#cleared").text(cleared.toFixed(2))
+    $("#closing").text(closing.toFixed(2))
+    $("#difference").text(difference.toFixed(2))
+    $("#finish").prop("disabled", difference != 0)
+  }
+  $("#balance").on("input", updateDifference)
+  $("input[name=cleared]").on("change", updateDifference)
+})
@@ -0,0 +1,23 @@
+// The charts of the monthly report - the report comes as JSON from the page
+$(function() {
+  var report = JSON.parse($("#report").text())
+  var colors = ["54, 162, 235", "255, 99, 132", "75, 192, 192", "255, 159, 64", "153, 102, 255", "255, 205, 86", "201, 203, 207"]
+  var comparisons = report.comparisons || []
+  function column(name) {
+    return comparisons.map(function (comparison) { return comparison[name] })
+  }
+  new Chart($("#comparison"), {type: 'bar', data: {
+    labels: column("category"),
+    datasets: [
+      {label: "Last year", backgroundColor: "rgba(" + colors[6] + ", 0.5)", data: column("last_year")},
+      {label: "Previous month", backgroundColor: "rgba(" + colors[0] + ", 0.5)", data: column("previous_month")},
+      {label: report.month, backgroundColor: "rgba(" + colors[4] + ", 0.8)", data: column("current")},
+    ],
+  }});
+  var trends = (report.trends || []).map(function (trend, i) {
+    return {label: trend.category, data: trend.amounts, fill: false,
+      borderColor: "rgba(" + colors[i % colors.length] + ", 1)",
+      backgroundColor: "rgba(" + colors[i % colors.length] + ", 0.2)"}
+  })
+  new Chart($("#trends"), {type: 'line', data: {labels: report.months, datasets: trends}});
+})
@@ -0,0 +1,14 @@
+// The remaining amount of a split, updated while typing
+$(function() {
+  var total = parseFloat($("#remaining").data("total"));
+  function update() {
+    var sum = 0;
+    $(".split-amount").each(function() { sum += parseFloat($(this).val()) || 0; });
+    var remaining = total - sum;
+    $("#remaining").text(remaining.toFixed(2) + " CHF")
+      .toggleClass("bg-success", Math.abs(remaining) < 0.005)
+      .toggleClass("bg-danger", Math.abs(remaining) >= 0.005);
+  }
+  $(".split-amount").on("input", update);
+  update();
+});
@@ -0,0 +1,41 @@
+// The charts of the stats page - their data comes as JSON from the page
+$(function() {
+  var stats = JSON.parse($("#stats").text())
+  var weekline = $("#weekline")
+  var data = {
+    labels: stats.dayLabels,
+    datasets: [
+      {
+        label: "Expenses",
+        backgroundColor: "rgba(75,192,192,0.4)",
+        borderColor: "rgba(75,192,192,1)",
+        borderCapStyle: 'round',
+        data: stats.dayValues,
+      }
+    ],
+  }
+  var monthbars = $("#monthbars")
+  var data2 = {
+    labels: stats.monLabels,
+    datasets: [
+      {
+        label: "Saved Money",
+        backgroundColor: "rgba(153, 102, 255, 0.2)",
+        borderColor: "rgba(153, 102, 255, 1)",
+        borderWidth: 2,
+        data: stats.monValues,
+      }
+    ],
+  }
+  var lineoptions = {
+    scales: {
+      yAxes: [{
+        ticks: {
+          beginAtZero: true
+        }
+      }]
+    }
+  }
+  new Chart(weekline, {type: 'line', data:data, options:lineoptions});
+  new Chart(monthbars, {type: 'bar', data:data2});
+})
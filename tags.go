@@ -0,0 +1,61 @@
+/*
+This file holds the tags - free-form labels on single transactions,
+like "vacation-italy-2026" or "reimbursable", independent of the category
+*/
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"unicode"
+)
+
+// TagTotal sums up the transactions with a tag
+type TagTotal struct {
+	Name     string  `json:"name"`
+	Count    int     `json:"count"`
+	Expenses float64 `json:"expenses"`
+	Income   float64 `json:"income"`
+}
+
+// Total returns income and expenses together
+func (t TagTotal) Total() float64 {
+	return t.Income + t.Expenses
+}
+
+// normalizeTag brings a tag into a form every export format understands:
+// lower case, only letters, digits and "-_./", everything else becomes "-".
+// "#Vacation Italy" becomes "vacation-italy".
+func normalizeTag(tag string) string {
+	var clean []rune
+	for _, r := range strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#")) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./", r):
+			clean = append(clean, r)
+		case len(clean) > 0 && clean[len(clean)-1] != '-':
+			clean = append(clean, '-')
+		}
+	}
+	return strings.Trim(string(clean), "-")
+}
+
+// parseTags splits a comma separated list of tags, like the one in the forms
+func parseTags(list string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(list, ",") {
+		if tag = normalizeTag(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// splitTags splits the comma separated tags as returned by sqlTagList
+func splitTags(list sql.NullString) []string {
+	if list.String == "" {
+		return nil
+	}
+	return strings.Split(list.String, ",")
+}
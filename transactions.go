@@ -0,0 +1,216 @@
+/*
+This file holds the transactions browser - all transactions filtered by
+date range, text, amount, kind, category and tag, sorted and paged.
+The web page and the API share it.
+*/
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The columns the transactions can be sorted by
+var transactionSorts = map[string]string{
+	"date":        "timestamp",
+	"amount":      "ABS(amount)",
+	"description": "description COLLATE NOCASE",
+	"category":    "COALESCE(mapping, '')",
+}
+
+// The number of transactions per page, by default and at most
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// TransactionFilter selects and orders the transactions of the browser.
+// Empty fields don't filter.
+type TransactionFilter struct {
+	From     string // first day, 2006-01-02
+	To       string // last day, 2006-01-02
+	Search   string // text in the description or note
+	Min      sql.NullFloat64
+	Max      sql.NullFloat64 // amount range, without sign
+	Kind     string          // "income" or "expense"
+	Category string          // including its sub-categories
+	Tag      string
+	Sort     string
+	Desc     bool
+	Page     int
+	PerPage  int
+}
+
+// parseTransactionFilter reads a filter from the query of a request:
+// from, to, q, min, max, kind, category, tag, sort, order (asc or desc), page and per_page.
+// Without a sort the newest transactions come first.
+func parseTransactionFilter(query url.Values) (TransactionFilter, error) {
+	f := TransactionFilter{From: query.Get("from"), To: query.Get("to"), Search: strings.TrimSpace(query.Get("q")),
+		Kind: query.Get("kind"), Category: query.Get("category"), Tag: query.Get("tag"),
+		Sort: query.Get("sort"), Desc: query.Get("order") == "desc", Page: 1, PerPage: defaultPerPage}
+	for _, date := range []string{f.From, f.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return f, fmt.Errorf("invalid date %q", date)
+		}
+	}
+	for name, value := range map[string]*sql.NullFloat64{"min": &f.Min, "max": &f.Max} {
+		if text := query.Get(name); text != "" {
+			amount, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid amount %q", text)
+			}
+			*value = sql.NullFloat64{Float64: amount, Valid: true}
+		}
+	}
+	switch f.Kind {
+	case "", "income", "expense":
+	default:
+		return f, errors.New("kind has to be income or expense")
+	}
+	if f.Sort == "" {
+		f.Sort, f.Desc = "date", query.Get("order") != "asc"
+	}
+	if _, ok := transactionSorts[f.Sort]; !ok {
+		return f, fmt.Errorf("can't sort by %q", f.Sort)
+	}
+	var err error
+	if page := query.Get("page"); page != "" {
+		if f.Page, err = strconv.Atoi(page); err != nil || f.Page < 1 {
+			return f, fmt.Errorf("invalid page %q", page)
+		}
+	}
+	if perPage := query.Get("per_page"); perPage != "" {
+		if f.PerPage, err = strconv.Atoi(perPage); err != nil || f.PerPage < 1 || f.PerPage > maxPerPage {
+			return f, fmt.Errorf("per_page has to be between 1 and %d", maxPerPage)
+		}
+	}
+	return f, nil
+}
+
+// where returns the SQL condition of the filter for the transactions of a budget with its
+// arguments. The query has to join transactions with mappings.
+func (f TransactionFilter) where(budget int) (string, []interface{}) {
+	conditions := []string{"budget = ?"}
+	args := []interface{}{budget}
+	if f.From != "" {
+		conditions = append(conditions, "date(timestamp) >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		conditions = append(conditions, "date(timestamp) <= ?")
+		args = append(args, f.To)
+	}
+	if f.Search != "" {
+		conditions = append(conditions, "(description LIKE ? ESCAPE '\\' OR note LIKE ? ESCAPE '\\')")
+		pattern := "%" + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(f.Search) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if f.Min.Valid {
+		conditions = append(conditions, "ABS(amount) >= ?")
+		args = append(args, f.Min.Float64)
+	}
+	if f.Max.Valid {
+		conditions = append(conditions, "ABS(amount) <= ?")
+		args = append(args, f.Max.Float64)
+	}
+	switch f.Kind {
+	case "income":
+		conditions = append(conditions, "amount > 0")
+	case "expense":
+		conditions = append(conditions, "amount <= 0")
+	}
+	if f.Category == uncategorised {
+		conditions = append(conditions, "transactions.id IN (SELECT transaction_id FROM postings WHERE COALESCE(mapping, '') = '')")
+	} else if f.Category != "" {
+		conditions = append(conditions, "transactions.id IN (SELECT transaction_id FROM postings WHERE mapping IN ("+
+			"WITH RECURSIVE subtree(id, name) AS (SELECT id, name FROM categories WHERE budget = ? AND name = ? "+
+			"UNION ALL SELECT categories.id, categories.name FROM categories JOIN subtree ON categories.parent = subtree.id) "+
+			"SELECT name FROM subtree))")
+		args = append(args, budget, f.Category)
+	}
+	return strings.Join(conditions, " AND ") + sqlTagFilter, append(args, f.Tag, f.Tag)
+}
+
+// orderBy returns the SQL ordering of the filter - the ID keeps the order stable between pages
+func (f TransactionFilter) orderBy() string {
+	direction := " ASC"
+	if f.Desc {
+		direction = " DESC"
+	}
+	return transactionSorts[f.Sort] + direction + ", transactions.id" + direction
+}
+
+// Link returns the query of the filter with a single value changed, for the links of the browser.
+// Changing anything but the page starts on the first page again.
+func (f TransactionFilter) Link(key, value string) string {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	set("from", f.From)
+	set("to", f.To)
+	set("q", f.Search)
+	if f.Min.Valid {
+		set("min", strconv.FormatFloat(f.Min.Float64, 'f', -1, 64))
+	}
+	if f.Max.Valid {
+		set("max", strconv.FormatFloat(f.Max.Float64, 'f', -1, 64))
+	}
+	set("kind", f.Kind)
+	set("category", f.Category)
+	set("tag", f.Tag)
+	set("sort", f.Sort)
+	if f.Desc {
+		set("order", "desc")
+	} else {
+		set("order", "asc")
+	}
+	if f.PerPage != defaultPerPage {
+		set("per_page", strconv.Itoa(f.PerPage))
+	}
+	if key == "page" {
+		set("page", value)
+	} else {
+		query.Set(key, value)
+	}
+	return "?" + query.Encode()
+}
+
+// SortLink returns the link sorting by a column - a second click reverses the order
+func (f TransactionFilter) SortLink(column string) string {
+	query := f.Link("sort", column)
+	if f.Sort == column && !f.Desc {
+		return strings.Replace(query, "order=asc", "order=desc", 1)
+	}
+	return strings.Replace(query, "order=desc", "order=asc", 1)
+}
+
+// Pages returns the number of pages for count transactions
+func (f TransactionFilter) Pages(count int) int {
+	if count == 0 {
+		return 1
+	}
+	return (count + f.PerPage - 1) / f.PerPage
+}
+
+// periodStart returns the first day of the current week (starting on Monday), month or year
+// as 2006-01-02 - the same days the summaries start on (UTC, like SQLite's date('now'))
+func periodStart(period string, now time.Time) string {
+	now = now.UTC()
+	switch period {
+	case "week":
+		now = now.AddDate(0, 0, -(int(now.Weekday())+6)%7)
+	case "month":
+		now = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		now = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return now.Format("2006-01-02")
+}